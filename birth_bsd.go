@@ -0,0 +1,20 @@
+//go:build darwin || freebsd || netbsd
+// +build darwin freebsd netbsd
+
+package rollinglogger
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// birthTime returns the creation time of the file described by info, or its
+// modification time if the filesystem does not record one.
+func birthTime(f file, info os.FileInfo) time.Time {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok || st.Birthtimespec.Sec <= 0 {
+		return info.ModTime()
+	}
+	return time.Unix(st.Birthtimespec.Unix())
+}
@@ -0,0 +1,68 @@
+package rollinglogger
+
+import (
+	"os"
+	"runtime"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+const (
+	atEmptyPath = 0x1000
+	statxBtime  = 0x800
+)
+
+// sysStatx is the statx system call number, which the syscall package does
+// not define on most architectures; 0 where it is not known here.
+var sysStatx = map[string]uintptr{
+	"386":   383,
+	"amd64": 332,
+	"arm":   397,
+	"arm64": 291,
+}[runtime.GOARCH]
+
+type statxTimestamp struct {
+	Sec  int64
+	Nsec uint32
+	_    int32
+}
+
+// statxT mirrors struct statx up to the timestamps, padded to its full size.
+type statxT struct {
+	Mask           uint32
+	Blksize        uint32
+	Attributes     uint64
+	Nlink          uint32
+	UID            uint32
+	GID            uint32
+	Mode           uint16
+	_              uint16
+	Ino            uint64
+	Size           uint64
+	Blocks         uint64
+	AttributesMask uint64
+	Atime          statxTimestamp
+	Btime          statxTimestamp
+	Ctime          statxTimestamp
+	Mtime          statxTimestamp
+	_              [16]uint64
+}
+
+// birthTime returns the creation time of f, described by info, as reported
+// by statx, or its modification time if the kernel or filesystem does not
+// record one.
+func birthTime(f file, info os.FileInfo) time.Time {
+	fd, ok := f.(interface{ Fd() uintptr })
+	if !ok || sysStatx == 0 {
+		return info.ModTime()
+	}
+	var stx statxT
+	empty := []byte{0}
+	_, _, errno := syscall.Syscall6(sysStatx, fd.Fd(), uintptr(unsafe.Pointer(&empty[0])),
+		atEmptyPath, statxBtime, uintptr(unsafe.Pointer(&stx)), 0)
+	if errno != 0 || stx.Mask&statxBtime == 0 || stx.Btime.Sec == 0 {
+		return info.ModTime()
+	}
+	return time.Unix(stx.Btime.Sec, int64(stx.Btime.Nsec))
+}
@@ -0,0 +1,15 @@
+//go:build !linux && !darwin && !freebsd && !netbsd
+// +build !linux,!darwin,!freebsd,!netbsd
+
+package rollinglogger
+
+import (
+	"os"
+	"time"
+)
+
+// birthTime returns the modification time of the file described by info,
+// as creation times are not available here.
+func birthTime(f file, info os.FileInfo) time.Time {
+	return info.ModTime()
+}
@@ -0,0 +1,68 @@
+package rollinglogger
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"hash"
+	"os"
+	"path/filepath"
+)
+
+// ChecksumAlgorithm selects the digest written next to each archive.
+type ChecksumAlgorithm int
+
+const (
+	// ChecksumNone writes no checksum files.
+	ChecksumNone ChecksumAlgorithm = iota
+	// ChecksumSHA256 writes <archive>.sha256 in the format of sha256sum.
+	ChecksumSHA256
+)
+
+const checksumExt = ".sha256"
+
+// newHash returns the hash for Checksum, nil if there is none.
+func (l *Logger) newHash() hash.Hash {
+	if l.Checksum == ChecksumSHA256 {
+		return sha256.New()
+	}
+	return nil
+}
+
+// writeChecksum writes the sidecar of archive, whose digest is sum. Like the
+// archive it is written to a temporary name first.
+func (l *Logger) writeChecksum(archive string, sum []byte) error {
+	name := archive + checksumExt
+	tmp := name + tmpExt
+	f, err := l.filesystem().OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, l.fileMode())
+	if err != nil {
+		return fmt.Errorf("error in opening checksum file %s", tmp)
+	}
+	_, err = fmt.Fprintf(f, "%x  %s\n", sum, filepath.Base(archive))
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = l.filesystem().Rename(tmp, name)
+	}
+	if err != nil {
+		_ = l.filesystem().Remove(tmp)
+		return fmt.Errorf("error in writing checksum file %s: %v", name, err)
+	}
+	return nil
+}
+
+// removeBackup removes a backup along with its checksum file, if any.
+func (l *Logger) removeBackup(path string) error {
+	err := l.filesystem().Remove(path)
+	if err != nil {
+		return err
+	}
+	err = l.filesystem().Remove(path + checksumExt)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,138 @@
+package rollinglogger
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// Codec compresses rotated files. The built-in codec is gzip; others such as
+// zstd can be plugged in without this package depending on them, e.g. with
+// github.com/klauspost/compress/zstd:
+//
+//	type zstdCodec struct{}
+//
+//	func (zstdCodec) Ext() string { return ".zst" }
+//
+//	func (zstdCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+//		return zstd.NewWriter(w)
+//	}
+type Codec interface {
+	// Ext is the extension of compressed backups, including the dot.
+	Ext() string
+	// NewWriter returns a writer compressing into w. Close must flush all
+	// data to w without closing w itself.
+	NewWriter(w io.Writer) (io.WriteCloser, error)
+}
+
+// gzipCodec is the default codec. It reuses gzip.Writers across rotations
+// through the Logger's pool instead of allocating new ones each time.
+type gzipCodec struct {
+	l *Logger
+}
+
+// pooledGzip returns itself to the pool on Close.
+type pooledGzip struct {
+	*gzip.Writer
+	level int
+	pool  *sync.Pool
+}
+
+func (p *pooledGzip) Close() error {
+	err := p.Writer.Close()
+	p.pool.Put(p)
+	return err
+}
+
+func (gzipCodec) Ext() string {
+	return ext
+}
+
+func (c gzipCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	level := c.l.compressionLevel()
+	if p, ok := c.l.gzPool.Get().(*pooledGzip); ok && p.level == level {
+		p.Reset(w)
+		return p, nil
+	}
+	gz, err := gzip.NewWriterLevel(w, level)
+	if err != nil {
+		return nil, err
+	}
+	return &pooledGzip{Writer: gz, level: level, pool: &c.l.gzPool}, nil
+}
+
+// copyFlushing copies r to the compressor zw, flushing it every
+// CompressFlushBytes if it can be flushed.
+func (l *Logger) copyFlushing(zw io.Writer, r io.Reader) (int64, error) {
+	f, ok := zw.(interface{ Flush() error })
+	if l.CompressFlushBytes <= 0 || !ok {
+		return io.Copy(zw, r)
+	}
+	var read int64
+	for {
+		n, err := io.CopyN(zw, r, l.CompressFlushBytes)
+		read += n
+		if n > 0 {
+			if ferr := f.Flush(); ferr != nil {
+				return read, ferr
+			}
+		}
+		if err == io.EOF {
+			return read, nil
+		}
+		if err != nil {
+			return read, err
+		}
+	}
+}
+
+// Decoder is implemented by codecs that can read back what they wrote, which
+// VerifyArchives relies on.
+type Decoder interface {
+	NewReader(r io.Reader) (io.ReadCloser, error)
+}
+
+func (gzipCodec) NewReader(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// verifyArchive checks that the archive at path decompresses cleanly.
+func (l *Logger) verifyArchive(codec Codec, path string) error {
+	dec, ok := codec.(Decoder)
+	if !ok {
+		return nil
+	}
+	f, err := l.filesystem().Open(path)
+	if err != nil {
+		return fmt.Errorf("error in opening compressed log file %s", path)
+	}
+	defer f.Close()
+	zr, err := dec.NewReader(f)
+	if err == nil {
+		_, err = io.Copy(ioutil.Discard, zr)
+		if cerr := zr.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("error in verifying compressed log file %s: %v", path, err)
+	}
+	return nil
+}
+
+func (l *Logger) codec() Codec {
+	switch {
+	case l.Codec != nil:
+		return l.Codec
+	case len(l.CompressCommand) > 0:
+		return commandCodec{args: l.CompressCommand, ext: l.CompressExt}
+	}
+	return gzipCodec{l: l}
+}
+
+// ext returns the extension of compressed backups.
+func (l *Logger) ext() string {
+	return l.codec().Ext()
+}
@@ -0,0 +1,90 @@
+package rollinglogger
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+// logData returns n bytes of log-like lines that compress to different
+// sizes at different levels.
+func logData(n int) []byte {
+	r := rand.New(rand.NewSource(1))
+	words := []string{"GET", "POST", "/api/users", "/api/orders", "200", "404", "500", "ok", "slow", "timeout"}
+	var b bytes.Buffer
+	for b.Len() < n {
+		fmt.Fprintf(&b, "%d %s %s %s %dms id=%x\n", r.Int63(), words[r.Intn(len(words))],
+			words[r.Intn(len(words))], words[r.Intn(len(words))], r.Intn(1000), r.Uint32())
+	}
+	return b.Bytes()[:n]
+}
+
+// archiveSize rotates data through a Logger at level and returns the size
+// of the archive.
+func archiveSize(t *testing.T, level int, data []byte) int64 {
+	t.Helper()
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	l := &Logger{Filename: filepath.Join(dir, "a.log"), CompressionLevel: level}
+	defer l.Close()
+	writeString(t, l, string(data))
+	if err := l.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	backups, err := l.Backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 || !backups[0].Compressed {
+		t.Fatalf("backups %+v, want one archive", backups)
+	}
+	return backups[0].Size
+}
+
+func TestCompressionLevel(t *testing.T) {
+	data := logData(1 << 20)
+	speed := archiveSize(t, gzip.BestSpeed, data)
+	best := archiveSize(t, gzip.BestCompression, data)
+	if speed <= best {
+		t.Errorf("BestSpeed archive is %d bytes, BestCompression %d, want it larger", speed, best)
+	}
+	if def := archiveSize(t, 0, data); def < best || def > speed {
+		t.Errorf("default level archive is %d bytes, want between %d and %d", def, best, speed)
+	}
+}
+
+// BenchmarkGzipWriter compares the pooled writers of gzipCodec with a new
+// gzip.Writer per archive, as compression used to allocate.
+func BenchmarkGzipWriter(b *testing.B) {
+	data := logData(4 << 10)
+	b.Run("pooled", func(b *testing.B) {
+		c := gzipCodec{l: &Logger{}}
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			zw, err := c.NewWriter(ioutil.Discard)
+			if err != nil {
+				b.Fatal(err)
+			}
+			zw.Write(data)
+			zw.Close()
+		}
+	})
+	b.Run("new", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			zw, err := gzip.NewWriterLevel(ioutil.Discard, gzip.DefaultCompression)
+			if err != nil {
+				b.Fatal(err)
+			}
+			zw.Write(data)
+			zw.Close()
+		}
+	})
+}
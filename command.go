@@ -0,0 +1,77 @@
+package rollinglogger
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"sync"
+)
+
+// commandCodec compresses by piping backups through CompressCommand.
+type commandCodec struct {
+	args []string
+	ext  string
+}
+
+func (c commandCodec) Ext() string {
+	if c.ext != "" {
+		return c.ext
+	}
+	return "." + filepath.Base(c.args[0])
+}
+
+func (c commandCodec) NewWriter(w io.Writer) (io.WriteCloser, error) {
+	cw := &commandWriter{cmd: exec.Command(c.args[0], c.args[1:]...)}
+	cw.cmd.Stdout = w
+	cw.cmd.Stderr = &cw.stderr
+	stdin, err := cw.cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	cw.stdin = stdin
+	err = cw.cmd.Start()
+	if err != nil {
+		return nil, fmt.Errorf("error in starting %s: %v", c.args[0], err)
+	}
+	return cw, nil
+}
+
+// commandWriter feeds a running compressor. The process is waited for
+// exactly once, on Close or on the first failed Write, so it never outlives
+// the archive it writes.
+type commandWriter struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stderr bytes.Buffer
+	once   sync.Once
+	err    error
+}
+
+func (c *commandWriter) Write(p []byte) (int, error) {
+	n, err := c.stdin.Write(p)
+	if err != nil {
+		// most likely the process exited; its own error says why
+		_ = c.cmd.Process.Kill()
+		if werr := c.wait(); werr != nil {
+			return n, werr
+		}
+	}
+	return n, err
+}
+
+func (c *commandWriter) Close() error {
+	return c.wait()
+}
+
+func (c *commandWriter) wait() error {
+	c.once.Do(func() {
+		c.stdin.Close()
+		err := c.cmd.Wait()
+		if err != nil {
+			c.err = fmt.Errorf("error in running %s: %v: %s", c.cmd.Args[0], err, bytes.TrimSpace(c.stderr.Bytes()))
+		}
+	})
+	return c.err
+}
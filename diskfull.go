@@ -0,0 +1,86 @@
+package rollinglogger
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// diskCheckInterval is how long a free space reading is reused.
+const diskCheckInterval = time.Second
+
+// DiskFullPolicy selects how a write reacts when the disk is full.
+type DiskFullPolicy int
+
+const (
+	// DiskFullFail returns the error to the caller.
+	DiskFullFail DiskFullPolicy = iota
+	// DiskFullDrop discards the write, reports it as successful and counts
+	// it in Stats, so logging does not fail every call while space is low.
+	DiskFullDrop
+	// DiskFullPrune deletes backups, oldest first, until the write fits,
+	// and fails once there are none left to delete.
+	DiskFullPrune
+)
+
+// retryDiskFull reports whether a write that failed with err should be
+// retried, having freed some space for it.
+func (l *Logger) retryDiskFull(err error) bool {
+	// a bufio.Writer keeps failing after its first error
+	if !isDiskFull(err) || l.DiskFull != DiskFullPrune || l.buf != nil {
+		return false
+	}
+	return l.pruneOldest()
+}
+
+// pruneOldest removes the oldest backup, reporting whether there was one.
+func (l *Logger) pruneOldest() bool {
+	backups, err := l.listBackups()
+	if err != nil {
+		return false
+	}
+	for i := len(backups) - 1; i >= 0; i-- {
+		err := l.removeBackup(backups[i].path)
+		if err == nil {
+			return true
+		}
+		if !os.IsNotExist(err) {
+			return false
+		}
+	}
+	return false
+}
+
+// checkDiskSpace fails while free space on the log's filesystem is below
+// MinFreeDiskPercent. Under DiskFullPrune it first deletes backups, oldest
+// first, to make room.
+func (l *Logger) checkDiskSpace() error {
+	if l.MinFreeDiskPercent <= 0 {
+		return nil
+	}
+	low, fresh := l.lowDisk(false)
+	// deleting is only worth trying on a new reading, not on every write
+	for low && fresh && l.DiskFull == DiskFullPrune && l.pruneOldest() {
+		low, _ = l.lowDisk(true)
+	}
+	if low {
+		return fmt.Errorf("%w: less than %d%% free for %s", ErrLowDiskSpace, l.MinFreeDiskPercent, l.filename())
+	}
+	return nil
+}
+
+// lowDisk reports whether free space is below MinFreeDiskPercent, reading it
+// again if refresh is set or the last reading is older than
+// diskCheckInterval, and whether it did so.
+func (l *Logger) lowDisk(refresh bool) (low, fresh bool) {
+	now := l.now()
+	if !refresh && !l.diskChecked.IsZero() && now.Sub(l.diskChecked) < diskCheckInterval {
+		return l.diskLow, false
+	}
+	l.diskChecked = now
+	avail, total, err := diskSpace(filepath.Dir(l.filename()))
+	// without a reading nothing is held back
+	l.diskLow = err == nil && avail*100 < total*uint64(l.MinFreeDiskPercent)
+	return l.diskLow, true
+}
@@ -0,0 +1,13 @@
+//go:build !plan9
+// +build !plan9
+
+package rollinglogger
+
+import (
+	"errors"
+	"syscall"
+)
+
+func isDiskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC)
+}
@@ -0,0 +1,43 @@
+//go:build !plan9
+// +build !plan9
+
+package rollinglogger
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestTeeSkipsDroppedWrites(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	full := false
+	fsys := &testFS{}
+	fsys.openFile = func(name string, flag int, perm os.FileMode) (file, error) {
+		f, err := fsys.osFS.OpenFile(name, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+		return &hookFile{file: f, write: func(p []byte) (int, error) {
+			if full {
+				return 0, &os.PathError{Op: "write", Path: name, Err: syscall.ENOSPC}
+			}
+			return f.Write(p)
+		}}, nil
+	}
+	var tee bytes.Buffer
+	l := &Logger{Filename: filepath.Join(dir, "a.log"), DiskFull: DiskFullDrop, Tee: &tee, fsys: fsys}
+	defer l.Close()
+
+	writeString(t, l, "one\n")
+	full = true
+	writeString(t, l, "dropped\n")
+	full = false
+	writeString(t, l, "two\n")
+	if got, want := tee.String(), "one\ntwo\n"; got != want {
+		t.Errorf("tee got %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,11 @@
+//go:build !darwin && !freebsd && !linux
+// +build !darwin,!freebsd,!linux
+
+package rollinglogger
+
+import "errors"
+
+// diskSpace is not available here, which turns MinFreeDiskPercent off.
+func diskSpace(path string) (avail, total uint64, err error) {
+	return 0, 0, errors.New("free disk space is not available on this platform")
+}
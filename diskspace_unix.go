@@ -0,0 +1,20 @@
+//go:build darwin || freebsd || linux
+// +build darwin freebsd linux
+
+package rollinglogger
+
+import "syscall"
+
+// diskSpace returns the space available to unprivileged users and the total
+// size of the filesystem holding path, in bytes.
+func diskSpace(path string) (avail, total uint64, err error) {
+	var st syscall.Statfs_t
+	err = syscall.Statfs(path, &st)
+	if err != nil {
+		return 0, 0, err
+	}
+	if st.Bavail > 0 {
+		avail = uint64(st.Bavail) * uint64(st.Bsize)
+	}
+	return avail, st.Blocks * uint64(st.Bsize), nil
+}
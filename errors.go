@@ -0,0 +1,72 @@
+package rollinglogger
+
+import (
+	"errors"
+	"fmt"
+)
+
+const errorBufferSize = 16
+
+var (
+	// ErrWriteTooLarge matches, with errors.Is, writes rejected for being
+	// larger than MaxSize or MaxLineSize. The error is a *WriteTooLargeError.
+	ErrWriteTooLarge = errors.New("write too large")
+	// ErrLocked matches failures to take the Exclusive lock because another
+	// process holds it.
+	ErrLocked = errors.New("log file locked by another process")
+	// ErrNoNewline is returned under RequireNewline for a write that does
+	// not end in a newline.
+	ErrNoNewline = errors.New("write does not end in a newline")
+	// ErrWriteTimeout matches writes that failed for WriteTimeout.
+	ErrWriteTimeout = errors.New("write timed out")
+	// ErrLowDiskSpace matches writes refused for MinFreeDiskPercent.
+	ErrLowDiskSpace = errors.New("free disk space too low")
+)
+
+// WriteTooLargeError is returned for a write longer than the limit.
+type WriteTooLargeError struct {
+	Len   int64 // length of the write in bytes
+	Limit int64 // largest write allowed
+}
+
+func (e *WriteTooLargeError) Error() string {
+	return fmt.Sprintf("write length %d larger than max size %d", e.Len, e.Limit)
+}
+
+// Is makes the error match ErrWriteTooLarge.
+func (e *WriteTooLargeError) Is(target error) bool {
+	return target == ErrWriteTooLarge
+}
+
+// Errors returns a channel carrying errors from background work such as
+// compression and removal of old backups. The channel is buffered; errors
+// that arrive while it is full are dropped and counted in Stats, so callers
+// interested in them should drain it continuously.
+func (l *Logger) Errors() <-chan error {
+	l.errOnce.Do(l.initErrors)
+	return l.errCh
+}
+
+func (l *Logger) initErrors() {
+	l.errCh = make(chan error, errorBufferSize)
+}
+
+// report hands a background error to ErrorHandler and to Errors, without
+// ever blocking on the latter.
+func (l *Logger) report(err error) {
+	l.handleError(err)
+	l.errOnce.Do(l.initErrors)
+	select {
+	case l.errCh <- err:
+	default:
+		l.millMu.Lock()
+		l.droppedErrors++
+		l.millMu.Unlock()
+	}
+}
+
+func (l *Logger) handleError(err error) {
+	if l.ErrorHandler != nil {
+		l.ErrorHandler(err)
+	}
+}
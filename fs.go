@@ -0,0 +1,85 @@
+package rollinglogger
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// fs is the set of filesystem operations the Logger performs. Tests can set
+// Logger.fsys to exercise rotation without touching the disk.
+type fs interface {
+	Open(name string) (file, error)
+	OpenFile(name string, flag int, perm os.FileMode) (file, error)
+	Stat(name string) (os.FileInfo, error)
+	Lstat(name string) (os.FileInfo, error)
+	Remove(name string) error
+	Rename(oldpath, newpath string) error
+	Link(oldname, newname string) error
+	MkdirAll(path string, perm os.FileMode) error
+	Symlink(oldname, newname string) error
+	ReadDir(dirname string) ([]os.FileInfo, error)
+}
+
+// file is the subset of *os.File the Logger uses.
+type file interface {
+	io.Reader
+	io.Writer
+	io.StringWriter
+	io.Closer
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// osFS implements fs with the os package.
+type osFS struct{}
+
+func (osFS) Open(name string) (file, error) {
+	return os.Open(name)
+}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (file, error) {
+	return os.OpenFile(name, flag, perm)
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(name)
+}
+
+// Remove and Rename retry on Windows while the file is briefly held open by
+// another process; the Logger itself always closes a file before either.
+func (osFS) Remove(name string) error {
+	return removeFile(name)
+}
+
+func (osFS) Rename(oldpath, newpath string) error {
+	return renameFile(oldpath, newpath)
+}
+
+func (osFS) Link(oldname, newname string) error {
+	return os.Link(oldname, newname)
+}
+
+func (osFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osFS) Symlink(oldname, newname string) error {
+	return os.Symlink(oldname, newname)
+}
+
+func (osFS) ReadDir(dirname string) ([]os.FileInfo, error) {
+	return ioutil.ReadDir(dirname)
+}
+
+func (l *Logger) filesystem() fs {
+	if l.fsys == nil {
+		return osFS{}
+	}
+	return l.fsys
+}
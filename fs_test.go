@@ -0,0 +1,117 @@
+package rollinglogger
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// testFS is the real filesystem with hooks to fake failures and sizes. A
+// nil hook passes the call through.
+type testFS struct {
+	osFS
+	mu       sync.Mutex
+	open     func(name string) (file, error)
+	rename   func(oldpath, newpath string) error
+	openFile func(name string, flag int, perm os.FileMode) (file, error)
+	stat     func(name string) (os.FileInfo, error)
+	flags    []int    // of every OpenFile call
+	removed  []string // base names of the files removed
+}
+
+func (f *testFS) Rename(oldpath, newpath string) error {
+	if f.rename != nil {
+		return f.rename(oldpath, newpath)
+	}
+	return f.osFS.Rename(oldpath, newpath)
+}
+
+func (f *testFS) Open(name string) (file, error) {
+	if f.open != nil {
+		return f.open(name)
+	}
+	return f.osFS.Open(name)
+}
+
+func (f *testFS) OpenFile(name string, flag int, perm os.FileMode) (file, error) {
+	f.mu.Lock()
+	f.flags = append(f.flags, flag)
+	f.mu.Unlock()
+	if f.openFile != nil {
+		return f.openFile(name, flag, perm)
+	}
+	return f.osFS.OpenFile(name, flag, perm)
+}
+
+func (f *testFS) Remove(name string) error {
+	err := f.osFS.Remove(name)
+	if err == nil {
+		f.mu.Lock()
+		f.removed = append(f.removed, filepath.Base(name))
+		f.mu.Unlock()
+	}
+	return err
+}
+
+func (f *testFS) Stat(name string) (os.FileInfo, error) {
+	if f.stat != nil {
+		return f.stat(name)
+	}
+	return f.osFS.Stat(name)
+}
+
+// openFlags returns the flags OpenFile was called with so far.
+func (f *testFS) openFlags() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]int(nil), f.flags...)
+}
+
+// removedNames returns the base names of the files removed so far, sorted.
+func (f *testFS) removedNames() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	names := append([]string(nil), f.removed...)
+	sort.Strings(names)
+	return names
+}
+
+// hookFile wraps a file to fake read, write and stat results.
+type hookFile struct {
+	file
+	read  func(p []byte) (int, error)
+	write func(p []byte) (int, error)
+	stat  func() (os.FileInfo, error)
+}
+
+func (f *hookFile) Read(p []byte) (int, error) {
+	if f.read != nil {
+		return f.read(p)
+	}
+	return f.file.Read(p)
+}
+
+func (f *hookFile) Write(p []byte) (int, error) {
+	if f.write != nil {
+		return f.write(p)
+	}
+	return f.file.Write(p)
+}
+
+func (f *hookFile) Stat() (os.FileInfo, error) {
+	if f.stat != nil {
+		return f.stat()
+	}
+	return f.file.Stat()
+}
+
+// sizedInfo reports a different size for a file.
+type sizedInfo struct {
+	os.FileInfo
+	size int64
+}
+
+func (i sizedInfo) Size() int64 {
+	return i.size
+}
@@ -0,0 +1,13 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package rollinglogger
+
+import "errors"
+
+func (l *Logger) lockFile(f file) error {
+	if !l.Exclusive {
+		return nil
+	}
+	return errors.New("exclusive mode is not supported on this platform")
+}
@@ -0,0 +1,33 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package rollinglogger
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// lockFile takes the advisory lock for Exclusive mode. Files that are not
+// backed by a descriptor, as in tests, are not locked.
+func (l *Logger) lockFile(f file) error {
+	if !l.Exclusive {
+		return nil
+	}
+	fd, ok := f.(interface{ Fd() uintptr })
+	if !ok {
+		return nil
+	}
+	how := syscall.LOCK_EX
+	if !l.ExclusiveWait {
+		how |= syscall.LOCK_NB
+	}
+	err := syscall.Flock(int(fd.Fd()), how)
+	if err == syscall.EWOULDBLOCK {
+		return fmt.Errorf("%w: %s", ErrLocked, l.filename())
+	}
+	if err != nil {
+		return fmt.Errorf("error in locking file %s: %v", l.filename(), err)
+	}
+	return nil
+}
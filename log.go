@@ -1,162 +1,1608 @@
 package rollinglogger
 
 import (
+	"bufio"
+	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 )
 
 const (
-	defaultMaxSize = 100
-	megabyte       = 1024 * 1024
-	ext            = ".gz"
-	timeFormat     = "2006-01-02-15-04-05"
+	defaultMaxSize  = 100
+	defaultDirPerm  = 0755
+	defaultFileMode = 0644
+	megabyte        = 1024 * 1024
+	ext             = ".gz"
+	tmpExt          = ".tmp"
+	stageExt        = ".staged"
+	previousExt     = ".1"
+	timeFormat      = "2006-01-02-15-04-05"
+	defaultBacklog  = 1000
+	minMaxSizeBytes = 4096
 )
 
+// RollingWriter is the behaviour of a Logger that code writing logs usually
+// depends on. *Logger implements it; tests can substitute a fake.
+type RollingWriter interface {
+	io.WriteCloser
+	// Rotate archives the current file and starts a new one.
+	Rotate() error
+}
+
+var _ RollingWriter = (*Logger)(nil)
+
 type Logger struct {
-	Filename string
-	MaxSize  int // in MB
-	size     int
-	fd       *os.File
-	mu       sync.Mutex
+	// Filename is the file written to. New makes it absolute; a relative
+	// path set directly follows changes of the working directory.
+	Filename   string
+	MaxSize    int // in MB
+	MaxBackups int // 0 keeps every backup
+	MaxAge     int // in days, 0 keeps backups regardless of age
+	// MaxSizeBytes, if set, is the rotation size in bytes and takes
+	// precedence over MaxSize. Validate rejects values below 4096, which
+	// would rotate after nearly every write.
+	MaxSizeBytes int64
+	// MaxTotalSize caps the combined size of all backups in MB, 0 means no
+	// cap. The active file is not counted.
+	MaxTotalSize int
+	// CleanupInterval limits retention passes to one per interval, however
+	// often the file rotates. Cleanup always runs one. When 0, retention is
+	// applied after every rotation.
+	CleanupInterval time.Duration
+	// DisableCompression keeps rotated files as they are instead of
+	// compressing them in the background. Rotation itself is always a
+	// rename, so it then never reads the file and costs the same whatever
+	// its size.
+	DisableCompression bool
+	// KeepUncompressed leaves the most recent backups uncompressed, so they
+	// are quick to grep and tail; older ones are compressed as they age out.
+	// Retention limits count both kinds.
+	KeepUncompressed int
+	// KeepPrevious keeps the most recently rotated file, uncompressed, at
+	// Filename plus ".1" so readers always find it under the same name. On
+	// the next rotation it moves on to a regular backup, stamped with the
+	// time it was last written; only then does retention or OnRotate see
+	// it. With NamingNumbered that backup becomes Filename.2.gz, in the
+	// style of logrotate's delaycompress.
+	KeepPrevious bool
+	// NamingScheme selects timestamped or numbered backup names. Numbered
+	// backups are named Filename.1, Filename.2.gz and so on, newest first,
+	// with Filename.1 left uncompressed like logrotate's delaycompress does;
+	// the background pass right after a rotation gives the new backup the
+	// number 1, or 2 with KeepPrevious, and shifts the older ones up, and
+	// MaxBackups caps how many are kept. Ages are taken from modification
+	// times.
+	NamingScheme NamingScheme
+	// CompressionLevel is passed to gzip. Zero and values outside
+	// gzip.BestSpeed..gzip.BestCompression mean gzip.DefaultCompression.
+	CompressionLevel int
+	// Codec compresses backups, gzip at CompressionLevel if nil. It has to
+	// be safe for concurrent use when MaxConcurrentCompressions exceeds 1.
+	Codec Codec
+	// CompressCommand, if set and Codec is not, compresses backups with an
+	// external program such as []string{"xz", "-9"}, which reads the backup
+	// on stdin and writes the archive to stdout.
+	CompressCommand []string
+	// CompressExt is the extension of CompressCommand's archives, by default
+	// a dot followed by the command's name.
+	CompressExt string
+	// MaxConcurrentCompressions bounds how many backups are compressed at
+	// once; further ones wait their turn. Defaults to 1.
+	MaxConcurrentCompressions int
+	// BackpressureThreshold is the number of backups waiting for or in
+	// compression at which rotation, and with it Write, blocks until the
+	// backlog shrinks. Defaults to 1000. Stats reports the backlog as
+	// CompressionQueue plus CompressionsRunning.
+	BackpressureThreshold int
+	// Checksum, if set, writes a checksum file next to each archive, which
+	// retention removes along with it.
+	Checksum ChecksumAlgorithm
+	// ContentHashNames names archives after the SHA-256 of the log data
+	// they hold, as <hash>-<name><ext> next to the plain backup, so equal
+	// logs get equal names. A backup whose archive already exists is
+	// dropped. Retention orders these archives by modification time.
+	ContentHashNames bool
+	// VerifyArchives decompresses every archive after writing it and keeps
+	// the plain backup if that fails. Codecs other than the default gzip are
+	// only verified if they implement Decoder.
+	VerifyArchives bool
+	// CompressFlushBytes, if set, flushes the compressor after every so many
+	// bytes of input, so an archive cut short by a crash can be read up to
+	// the last flush. It costs some compression and applies to codecs whose
+	// writer has a Flush method, such as the default gzip.
+	CompressFlushBytes int64
+	// RotationPeriod rotates the file on the first write of each period,
+	// such as time.Hour or 24 * time.Hour, in addition to any size based
+	// rotation. Periods are aligned to local midnight. Zero disables time
+	// based rotation.
+	RotationPeriod time.Duration
+	// Daily is shorthand for a RotationPeriod of one day.
+	Daily bool
+	// BackupDir is where backups are kept, the directory of Filename if
+	// empty. Rotation renames the file into it; if BackupDir is on another
+	// filesystem the backup waits next to Filename, with a ".staged"
+	// suffix, until the background pass has copied or compressed it over.
+	BackupDir string
+	// BackupNameFunc, if set, names backups instead of the default
+	// <timestamp>-<seq>-<base> scheme. It gets Filename and the rotation
+	// time and returns a base name, without the compression extension which
+	// is appended when the backup is compressed. Names must be unique.
+	// ParseBackupName must be set with it: backups are found, compressed and
+	// pruned by their names, and rotation fails without it.
+	BackupNameFunc func(filename string, t time.Time) string
+	// ParseBackupName reverses BackupNameFunc, returning the time a backup
+	// name was made for and whether the name is a backup at all.
+	ParseBackupName func(name string) (time.Time, bool)
+	// BackupPathFunc, if set, returns where a backup goes relative to
+	// BackupDir, given the rotation time and the backup's name, such as
+	// filepath.Join(t.Format("2006/01/02"), name) for a directory per day.
+	// Missing directories are created and retention searches the whole
+	// tree below BackupDir, so the last element of the path still has to
+	// be a name that is recognized as a backup, and other files in the
+	// tree must not look like one. Directories emptied by retention are
+	// removed.
+	BackupPathFunc func(t time.Time, name string) string
+	// UTC stamps backup names in UTC instead of local time.
+	UTC bool
+	// Location, if set, is the time zone backup names are stamped in,
+	// taking precedence over UTC.
+	Location *time.Location
+	// TimeFormat is the time layout of the stamp in backup names,
+	// "2006-01-02-15-04-05" if unset. The stamp is followed by a sequence
+	// number. It must hold the full date and time to the second, so that it
+	// parses back to the time it was made for; Validate rejects others.
+	TimeFormat string
+	// Generations adds a generation number to backup names, as
+	// <stamp>-<seq>-g<n>-<name>, one higher for every rotation, so a missing
+	// backup shows as a gap. The count continues from the highest number
+	// among the existing backups. It does not apply to BackupNameFunc names.
+	Generations bool
+	// DirPerm is the mode of directories created for Filename, 0755 if unset.
+	DirPerm os.FileMode
+	// FileMode is the mode of created log files and backups, 0644 if unset.
+	FileMode os.FileMode
+	// PreserveOwner gives the new log file and archives the uid and gid of
+	// the file they replace. It needs the privileges to chown and is ignored
+	// on platforms without file owners; failures are reported on Errors.
+	PreserveOwner bool
+	// RefreshSize re-stats the open file before every rotation decision, so
+	// the size stays accurate when the file is truncated or appended to by
+	// someone else. It costs one fstat per write.
+	RefreshSize bool
+	// BufferSize, if positive, buffers writes in memory up to that many
+	// bytes. The buffer is flushed when full and on Sync, Rotate and Close,
+	// so data still in it is lost if the process dies without closing.
+	BufferSize int
+	// WatchFile checks before every write that Filename still is the open
+	// file and reopens it if it was deleted or replaced. It costs two stats
+	// per write.
+	WatchFile bool
+	// Exclusive takes an advisory lock on the log file while it is open, so
+	// that a second process configured with the same Filename fails instead
+	// of interleaving writes. The lock is released when the file is closed,
+	// including on rotation. Only supported on Unix systems with flock.
+	Exclusive bool
+	// ExclusiveWait makes Exclusive wait for the lock instead of failing.
+	ExclusiveWait bool
+	// WriteTimeout bounds how long a write may block, for instance on a
+	// stalled network filesystem. A write that takes longer returns an
+	// error and releases the Logger, though it keeps running in the
+	// background; writes made before it finishes fail straight away, while
+	// Rotate, Sync and Close wait for it.
+	WriteTimeout time.Duration
+	// DropOnTimeout reports writes that hit WriteTimeout as successful
+	// instead of failing them. They are counted in Stats either way.
+	DropOnTimeout bool
+	// WriteThrough opens the log file with O_SYNC, so that the kernel
+	// commits every write to stable storage before it returns. Like
+	// SyncOnWrite it costs a disk flush per write, which is much slower,
+	// but needs no separate fsync call.
+	WriteThrough bool
+	// Preallocate reserves MaxSize bytes of disk for every new file, on
+	// Linux, so that it is laid out in one piece and a lack of space shows
+	// early. The size of the file is unaffected and whatever is left unused
+	// is released when it is closed.
+	Preallocate bool
+	// FlushInterval, if set, makes a background goroutine flush the buffer
+	// and sync the file at that interval. The same goroutine rotates the
+	// file when RotationPeriod or Daily is set, at the start of each period
+	// even when nothing is written. It runs while the file is open and is
+	// stopped by Close and Shutdown.
+	FlushInterval time.Duration
+	// SyncOnWrite fsyncs the file after every write. This makes each write
+	// durable at the cost of a disk flush per call, which is much slower.
+	SyncOnWrite bool
+	// RequireNewline rejects writes that do not end in a newline with
+	// ErrNoNewline, so that a rotation never splits a record between files.
+	RequireNewline bool
+	// AppendNewline adds the missing newline to such writes instead.
+	AppendNewline bool
+	// MaxLines, if set, rotates the file before a write that would take it
+	// past that many lines, counted as newlines written. Lines already in
+	// a file that is appended to after a restart are not counted, so such a
+	// file may end up longer. Applies together with MaxSize.
+	MaxLines int
+	// MemoryBufferSize, if set, keeps up to that many bytes of records in
+	// memory while the file cannot be opened or written, instead of failing
+	// Write, WriteString and WriteBatch. They are written out, in order,
+	// by the first write that finds the file usable again. When the buffer
+	// is full the oldest records are discarded and counted in Stats.
+	MemoryBufferSize int
+	// Tee, if set, receives a copy of everything successfully written to
+	// the log file, such as os.Stdout during a migration. Records held in
+	// the memory buffer reach it once they are written out; dropped writes
+	// never do. Its errors are reported on Errors and do not fail the
+	// write. It is called with the Logger's lock held.
+	Tee io.Writer
+	// Header is written at the start of every new log file, counting
+	// towards MaxSize. Files that are appended to are left as they are.
+	Header []byte
+	// HeaderFunc, if set, is called for the header instead of using Header.
+	HeaderFunc func() []byte
+	// ShouldRotate, if set, is asked before every write that the size and
+	// time limits let through whether to rotate anyway, given the size of
+	// the current file and when it was opened. It runs with the Logger's
+	// lock held, so it has to be fast and must not use the Logger.
+	ShouldRotate func(currentSize int64, openedAt time.Time) bool
+	// PreRotateFunc is called with the current file just before it is
+	// rotated, to let formats that need one write a footer. An error aborts
+	// the rotation, leaving the file in place, and is returned.
+	PreRotateFunc func(w io.Writer) error
+	// SkipEmpty makes rotation a no-op while the current file is empty, or
+	// holds nothing but the header, so quiet periods don't leave empty
+	// backups behind.
+	SkipEmpty bool
+	// FallbackDir, if set, is where the log file moves when it cannot be
+	// opened in its own directory, for instance because that is read-only.
+	// The switch is reported on Errors and in Stats and lasts until the
+	// Logger is discarded; backups follow unless BackupDir is set. Set it
+	// to os.TempDir() to keep logging in a misconfigured container.
+	FallbackDir string
+	// LinkName, if set, is kept as a symlink to Filename, giving tools like
+	// tail -F a stable path to follow.
+	LinkName string
+	// MaxLineSize limits the size of a single write in bytes, independently
+	// of MaxSize. When 0, writes are limited to MaxSize unless
+	// AllowOversized is set. A write larger than MaxSize but within
+	// MaxLineSize is handled as described for AllowOversized.
+	MaxLineSize int
+	// DiskFull decides what a write does when the disk is full.
+	DiskFull DiskFullPolicy
+	// MinFreeDiskPercent, if set, refuses writes with ErrLowDiskSpace while
+	// less than this share of the log's filesystem is free, keeping the
+	// system usable before it runs out. DiskFull applies: DiskFullDrop
+	// discards such writes and DiskFullPrune deletes backups to make room.
+	// The reading is reused for a second; it is only taken on Linux, macOS
+	// and FreeBSD.
+	MinFreeDiskPercent int
+	// AllowOversized accepts writes larger than MaxSize instead of failing
+	// them. The current file is rotated first, so the oversized write starts
+	// a new file and that file alone exceeds MaxSize; the next write rotates
+	// it again.
+	AllowOversized bool
+	// ErrorHandler, if set, is told about internal failures: those of
+	// background work, which also go to Errors, and failures to open or
+	// rotate the file, which the Write that ran into them returns as well.
+	// It may be called with the Logger's lock held and must not write to
+	// the Logger.
+	ErrorHandler func(err error)
+	// OnRotate is called with the path of every new backup once it is
+	// complete, that is after compression unless DisableCompression is set.
+	// It runs on a background goroutine of its own, outside the Logger's
+	// lock, one call at a time, and may call any method of the Logger.
+	OnRotate func(backupPath string)
+
+	size      int64
+	headerLen int64 // bytes of the current file taken by the header
+	lines     int   // lines written to the current file, with MaxLines
+	openTime  time.Time
+	// lastStamp and lastSeq remember the previous backup name so that the
+	// sequence keeps increasing within a second.
+	lastStamp string
+	lastSeq   int
+	// gen is the number of the newest backup with Generations, valid once
+	// genLoaded is set.
+	gen       int
+	genLoaded bool
+	scanned   bool             // whether leftovers from earlier runs were looked for
+	fromNew   bool             // made by New, so kept in the registry while open
+	clock     func() time.Time // defaults to time.Now, overridden by tests
+	fd        file
+	buf       *bufio.Writer // wraps fd when BufferSize is set
+	fsys      fs            // defaults to the os package, overridden by tests
+	mu        sync.Mutex
+
+	millQueue      []chan error // mill requests not yet started, nil for a plain pass
+	millRunning    bool         // the mill goroutine is running
+	startMill      sync.Once
+	millMu         sync.Mutex
+	millCond       *sync.Cond
+	millPending    int       // mill requests not yet completed
+	millErrs       []error   // errors of background passes, for Flush
+	renamed        []string  // uncompressed backups waiting for OnRotate
+	lastCleanup    time.Time // of the last retention pass, mill goroutine only
+	gzPool         sync.Pool // of *pooledGzip
+	compressQueue  int       // plain backups waiting for a compression slot
+	compressNew    int       // backups rotated since the last scan, when compressing
+	compressActive int       // compressions running
+	compressedIn   uint64    // bytes of backups compressed so far
+	compressedOut  uint64    // bytes of the archives made of them
+
+	notifyQueue   []string // backups waiting for OnRotate
+	notifyRunning bool     // the OnRotate goroutine is running
+	notifying     bool     // OnRotate is running
+
+	errOnce       sync.Once
+	errCh         chan error
+	droppedErrors uint64
+	backupCount   int // as of the last mill pass
+
+	rotations     uint64
+	diskFullDrops uint64
+	diskChecked   time.Time // of the last free space reading
+	diskLow       bool      // whether it was below MinFreeDiskPercent
+	writeTimeouts uint64
+	droppedWrites uint64
+	failedBytes   uint64
+	bytesWritten  uint64
+	lastRotation  time.Time
+
+	fallback string // path in FallbackDir once in use, guarded by millMu
+
+	mem memoryBuffer // with MemoryBufferSize
+
+	stalled *stall // write that timed out and has not returned yet
+
+	tickStop chan struct{} // closed to stop the ticker goroutine
+	tickDone chan struct{} // closed by the ticker goroutine on exit
 }
 
 func (l *Logger) Write(p []byte) (n int, err error) {
 	l.mu.Lock()
 	defer l.mu.Unlock()
-	cursize := len(p)
-	if cursize > l.max() {
-		return 0, fmt.Errorf("write length %d larger than the maxsize", cursize, l.max())
+	return l.writeBytes(p)
+}
+
+// WriteString is like Write but avoids converting s to a byte slice.
+func (l *Logger) WriteString(s string) (n int, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	orig := len(s)
+	add, err := l.checkNewline(orig == 0 || s[orig-1] == '\n')
+	if err != nil {
+		l.failed(int64(orig), 0)
+		return 0, err
+	}
+	if add {
+		s += "\n"
+	}
+	n, err = l.writeRecord(int64(len(s)), l.linesInString(s), func(off int) (int, error) {
+		return l.out().WriteString(s[off:])
+	}, func(n int) []byte {
+		return []byte(s[n:])
+	}, func() {
+		_, terr := io.WriteString(l.Tee, s)
+		l.teeFailed(terr)
+	})
+	if n > orig {
+		n = orig
+	}
+	return n, err
+}
+
+// WriteBatch writes records in order under a single lock acquisition,
+// rotating between records as needed. It stops at the first error and
+// returns the number of bytes written until then.
+func (l *Logger) WriteBatch(records [][]byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	total := 0
+	for _, p := range records {
+		n, err := l.writeBytes(p)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// ReadFrom copies r to the log until EOF, letting *Logger serve as an
+// io.ReaderFrom. The stream is split wherever needed to keep files within
+// MaxSize, so unlike Write it does not keep data together. The lock is
+// taken per chunk read, so other writes can land between chunks, and the
+// newline options do not apply.
+func (l *Logger) ReadFrom(r io.Reader) (int64, error) {
+	buf := make([]byte, 32*1024)
+	var total int64
+	for {
+		n, rerr := r.Read(buf)
+		if n > 0 {
+			m, err := l.writeChunk(buf[:n])
+			total += int64(m)
+			if err != nil {
+				return total, err
+			}
+		}
+		if rerr == io.EOF {
+			return total, nil
+		}
+		if rerr != nil {
+			return total, rerr
+		}
+	}
+}
+
+// writeChunk writes a piece of a ReadFrom stream, filling up the current
+// file before rotating.
+func (l *Logger) writeChunk(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.WriteTimeout > 0 {
+		// ReadFrom reuses its buffer while a timed out write may still use p
+		p = append([]byte(nil), p...)
 	}
 	if l.fd == nil {
-		err := l.openFile(cursize)
+		// open first so the space left in the file is known
+		err := l.prepare(0, 0)
 		if err != nil {
 			return 0, err
 		}
 	}
+	written := 0
+	for len(p) > 0 {
+		limit := l.max() - l.size
+		if limit <= 0 {
+			// rotate now, so the limit allows for the new file's header
+			err := l.makeNewFile()
+			if err != nil {
+				l.handleError(err)
+				return written, err
+			}
+			limit = l.max() - l.size
+			if limit <= 0 {
+				limit = l.max()
+			}
+		}
+		if most, ok := l.maxWrite(); ok && most < limit {
+			limit = most
+		}
+		chunk := p
+		if int64(len(chunk)) > limit {
+			chunk = chunk[:limit]
+		}
+		n, err := l.write(int64(len(chunk)), l.linesIn(chunk), func(off int) (int, error) {
+			return l.out().Write(chunk[off:])
+		}, l.teeBytes(chunk))
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
 
-	if l.size+cursize > l.max() {
+// writeBytes writes one record for Write and WriteBatch. The returned count
+// never includes a newline added by AppendNewline.
+func (l *Logger) writeBytes(p []byte) (int, error) {
+	orig := len(p)
+	add, err := l.checkNewline(orig == 0 || p[orig-1] == '\n')
+	if err != nil {
+		l.failed(int64(orig), 0)
+		return 0, err
+	}
+	if add {
+		// the capacity limit makes append copy rather than write into the
+		// caller's array
+		p = append(p[:orig:orig], '\n')
+	} else if l.WriteTimeout > 0 {
+		// a timed out write goes on using p after Write returns
+		p = append([]byte(nil), p...)
+	}
+	n, err := l.writeRecord(int64(len(p)), l.linesIn(p), func(off int) (int, error) {
+		return l.out().Write(p[off:])
+	}, func(n int) []byte {
+		return append([]byte(nil), p[n:]...)
+	}, l.teeBytes(p))
+	if n > orig {
+		n = orig
+	}
+	return n, err
+}
+
+// linesIn counts the lines of p for MaxLines, and does not bother when it
+// is unset.
+func (l *Logger) linesIn(p []byte) int {
+	if l.MaxLines <= 0 {
+		return 0
+	}
+	return bytes.Count(p, []byte{'\n'})
+}
+
+func (l *Logger) linesInString(s string) int {
+	if l.MaxLines <= 0 {
+		return 0
+	}
+	return strings.Count(s, "\n")
+}
+
+// teeBytes returns the function that copies p to Tee once it is in the
+// file.
+func (l *Logger) teeBytes(p []byte) func() {
+	return func() {
+		_, terr := l.Tee.Write(p)
+		l.teeFailed(terr)
+	}
+}
+
+// teeFailed reports a failed write to Tee; the log file is what counts.
+func (l *Logger) teeFailed(err error) {
+	if err != nil {
+		l.report(fmt.Errorf("error in writing to tee: %v", err))
+	}
+}
+
+// checkNewline applies RequireNewline and AppendNewline to a record,
+// reporting whether a newline has to be appended to it.
+func (l *Logger) checkNewline(terminated bool) (bool, error) {
+	switch {
+	case terminated:
+		return false, nil
+	case l.AppendNewline:
+		return true, nil
+	case l.RequireNewline:
+		return false, ErrNoNewline
+	}
+	return false, nil
+}
+
+// write writes a payload of size bytes and lines lines, handing w the offset
+// to write from. Once all of it is in the file, tee copies it to Tee if that
+// is set; dropped and timed out writes are not copied.
+func (l *Logger) write(size int64, lines int, w func(off int) (int, error), tee func()) (int, error) {
+	if !l.settle(false) {
+		l.writeTimeouts++
+		return l.timedOut(0, size, fmt.Errorf("%w: earlier write to %s still blocked", ErrWriteTimeout, l.filename()))
+	}
+	err := l.prepare(size, lines)
+	if err != nil {
+		if !errors.Is(err, ErrWriteTooLarge) {
+			l.handleError(err)
+		}
+		l.failed(size, 0)
+		return 0, err
+	}
+	err = l.checkDiskSpace()
+	if err != nil {
+		l.failed(size, 0)
+		if l.DiskFull == DiskFullDrop {
+			l.diskFullDrops++
+			return int(size), nil
+		}
+		l.handleError(err)
+		return 0, err
+	}
+
+	n, err := l.writeOut(w, 0)
+	for err != nil && l.stalled == nil && l.retryDiskFull(err) {
+		var m int
+		m, err = l.writeOut(w, n)
+		n += m
+	}
+	// count what reached the file even if the write failed part way, so
+	// size accounting matches the disk
+	l.size += int64(n)
+	l.bytesWritten += uint64(n)
+	if l.stalled != nil {
+		return l.timedOut(n, size, err)
+	}
+	if n == int(size) {
+		l.lines += lines
+	}
+	if err != nil {
+		l.failed(size, n)
+		if isDiskFull(err) && l.DiskFull == DiskFullDrop {
+			l.diskFullDrops++
+			return int(size), nil
+		}
+		return n, err
+	}
+	if l.Tee != nil {
+		tee()
+	}
+	if l.SyncOnWrite {
+		err = l.sync()
+	}
+	return n, err
+}
+
+// timedOut returns err for a write that hit WriteTimeout, or drops it
+// under DropOnTimeout.
+func (l *Logger) timedOut(n int, size int64, err error) (int, error) {
+	l.failed(size, n)
+	if l.DropOnTimeout {
+		return int(size), nil
+	}
+	return n, err
+}
+
+// failed counts a write of size bytes that only got n of them to the file.
+func (l *Logger) failed(size int64, n int) {
+	l.droppedWrites++
+	l.failedBytes += uint64(size) - uint64(n)
+}
+
+// prepare makes sure a file is open that can take cursize more bytes and
+// curlines more lines, rotating first if needed.
+func (l *Logger) prepare(cursize int64, curlines int) error {
+	if limit, ok := l.maxWrite(); ok && cursize > limit {
+		return &WriteTooLargeError{Len: cursize, Limit: limit}
+	}
+	oversized := cursize > l.max()
+	if l.fd == nil {
+		err := l.openFile(cursize)
+		if err != nil && l.useFallback(err) {
+			err = l.openFile(cursize)
+		}
+		if err != nil {
+			return err
+		}
+		if !l.scanned {
+			l.scanned = true
+			l.mill()
+		}
+	}
+
+	if l.WatchFile {
+		err := l.checkFile()
+		if err != nil {
+			return err
+		}
+	}
+
+	if l.RefreshSize {
+		err := l.refreshSize()
+		if err != nil {
+			return err
+		}
+	}
+
+	rotate := l.size+cursize > l.max() ||
+		l.MaxLines > 0 && l.lines > 0 && l.lines+curlines > l.MaxLines
+	if oversized && l.size == l.headerLen {
+		// the oversized write already has a fresh file to itself
+		rotate = false
+	}
+	if rotate || l.periodChanged() || l.ShouldRotate != nil && l.ShouldRotate(l.size, l.openTime) {
 		err := l.makeNewFile()
 		if err != nil {
-			return 0, err
+			return err
 		}
 	}
+	return nil
+}
 
-	n, err = l.fd.Write(p)
+func (l *Logger) openFile(curlen int64) error {
+	err := l.appendFile()
 	if err != nil {
-		return 0, err
+		return err
+	}
+	if l.size > 0 && l.size >= l.max() {
+		// already full, for instance because MaxSize was lowered since the
+		// file was written; never append to it, whatever the write
+		return l.makeNewFile()
+	}
+	if l.period() > 0 {
+		// continue the existing file after a restart within the same
+		// period; prepare still rotates if the period changed or the write
+		// doesn't fit
+		return nil
+	}
+	if l.size > 0 && l.size+curlen >= l.max() {
+		return l.makeNewFile()
 	}
-	l.size += n
-	return n, nil
+	return nil
 }
 
-func (l *Logger) openFile(curlen int) error {
-	fileinfo, err := os.Stat(l.Filename)
+// appendFile opens l.Filename for appending, creating it if it does not
+// exist. The size is taken from the opened file rather than the path, so the
+// file cannot change between the check and the open.
+func (l *Logger) appendFile() error {
+	flag := l.openFlags(os.O_CREATE | os.O_WRONLY | os.O_APPEND)
+	file, err := l.filesystem().OpenFile(l.filename(), flag, l.fileMode())
 	if os.IsNotExist(err) {
-		return l.openNewFile()
+		err = l.filesystem().MkdirAll(filepath.Dir(l.filename()), l.dirPerm())
+		if err != nil {
+			return fmt.Errorf("error in creating directory for %s: %v", l.filename(), err)
+		}
+		file, err = l.filesystem().OpenFile(l.filename(), flag, l.fileMode())
 	}
 	if err != nil {
-		return fmt.Errorf("error in getting file %s stat", l.Filename)
+		return fmt.Errorf("error in opening file %s ", l.filename())
 	}
-	if int(fileinfo.Size())+curlen >= l.max() {
-		return l.makeNewFile()
+	err = l.lockFile(file)
+	if err != nil {
+		file.Close()
+		return err
 	}
-	file, err := os.OpenFile(l.Filename, os.O_WRONLY|os.O_APPEND, 0755)
+	fileinfo, err := file.Stat()
 	if err != nil {
-		return fmt.Errorf("error in opening file %s ", l.Filename)
+		file.Close()
+		return fmt.Errorf("error in getting file %s stat", l.filename())
+	}
+	l.setFile(file)
+	l.size = fileinfo.Size()
+	l.headerLen = 0
+	// lines already in the file are not counted
+	l.lines = 0
+	// the period of a file continued after a restart is that of its
+	// creation, where the platform records it
+	l.openTime = birthTime(file, fileinfo)
+	l.link()
+	if l.size == 0 {
+		// a new file, or one with nothing worth keeping the date of
+		l.preallocate(file)
+		l.openTime = l.now()
+		return l.writeHeader()
+	}
+	return nil
+}
+
+// checkFile reopens Filename if it no longer refers to the open file, for
+// instance because it was deleted or renamed by someone else.
+func (l *Logger) checkFile() error {
+	current, err := l.fd.Stat()
+	if err != nil {
+		return fmt.Errorf("error in getting file %s stat", l.filename())
+	}
+	fileinfo, err := l.filesystem().Stat(l.filename())
+	missing := os.IsNotExist(err)
+	if err != nil && !missing {
+		return fmt.Errorf("error in getting file %s stat", l.filename())
+	}
+	if !missing && os.SameFile(current, fileinfo) {
+		return nil
+	}
+	err = l.close()
+	if err != nil {
+		return err
+	}
+	if missing {
+		return l.openNewFile()
+	}
+	return l.appendFile()
+}
+
+func (l *Logger) refreshSize() error {
+	fileinfo, err := l.fd.Stat()
+	if err != nil {
+		return fmt.Errorf("error in getting file %s stat", l.filename())
+	}
+	l.size = fileinfo.Size()
+	if l.buf != nil {
+		l.size += int64(l.buf.Buffered())
 	}
-	l.fd = file
-	l.size = int(fileinfo.Size())
 	return nil
 }
 
 func (l *Logger) openNewFile() error {
-	file, err := os.OpenFile(l.Filename, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0755)
+	err := l.filesystem().MkdirAll(filepath.Dir(l.filename()), l.dirPerm())
 	if err != nil {
-		return fmt.Errorf("error in opening file %s ", l.Filename)
+		return fmt.Errorf("error in creating directory for %s: %v", l.filename(), err)
 	}
-	l.fd = file
+	flag := l.openFlags(os.O_CREATE | os.O_WRONLY | os.O_TRUNC)
+	if l.Exclusive {
+		// only truncate once the lock shows nobody else is using the file
+		flag &^= os.O_TRUNC
+	}
+	file, err := l.filesystem().OpenFile(l.filename(), flag, l.fileMode())
+	if err != nil {
+		return fmt.Errorf("error in opening file %s ", l.filename())
+	}
+	if l.Exclusive {
+		err = l.lockFile(file)
+		if err == nil {
+			err = file.Truncate(0)
+		}
+		if err != nil {
+			file.Close()
+			return err
+		}
+	}
+	l.setFile(file)
+	l.preallocate(file)
 	l.size = 0
+	l.lines = 0
+	l.openTime = l.now()
+	l.link()
+	return l.writeHeader()
+}
+
+// writeHeader starts a new file with the header, if any.
+func (l *Logger) writeHeader() error {
+	header := l.Header
+	if l.HeaderFunc != nil {
+		header = l.HeaderFunc()
+	}
+	l.headerLen = 0
+	if len(header) == 0 {
+		return nil
+	}
+	n, err := l.out().Write(header)
+	l.size += int64(n)
+	l.headerLen = int64(n)
+	if err != nil {
+		return fmt.Errorf("error in writing header to %s: %v", l.filename(), err)
+	}
 	return nil
 }
 
+// link points LinkName at the log file. Failures are reported on Errors
+// rather than failing the write, since the link is only a convenience.
+func (l *Logger) link() {
+	if l.LinkName == "" {
+		return
+	}
+	target, err := filepath.Abs(l.filename())
+	if err != nil {
+		target = l.filename()
+	}
+	tmp := l.LinkName + tmpExt
+	_ = l.filesystem().Remove(tmp)
+	err = l.filesystem().Symlink(target, tmp)
+	if err == nil {
+		err = l.filesystem().Rename(tmp, l.LinkName)
+	}
+	if err != nil {
+		l.report(fmt.Errorf("error in linking %s to %s: %v", l.LinkName, l.filename(), err))
+	}
+}
+
 func (l *Logger) makeNewFile() error {
+	if l.SkipEmpty && l.isEmpty() {
+		// keep the empty file, it simply starts the new period
+		if l.fd != nil {
+			l.openTime = l.now()
+		}
+		return nil
+	}
+	if l.PreRotateFunc != nil && l.fd != nil {
+		err := l.PreRotateFunc(footerWriter{l})
+		if err != nil {
+			return fmt.Errorf("error in finishing file %s before rotation: %v", l.filename(), err)
+		}
+	}
+	if l.compress() {
+		l.waitBacklog()
+	}
 	err := l.close()
 	if err != nil {
 		return err
 	}
 
-	err = l.composeFile()
+	var prev os.FileInfo
+	if l.PreserveOwner {
+		prev, _ = l.filesystem().Stat(l.filename())
+	}
+	// renaming is atomic and independent of the file size; the new file is
+	// created right after, before the lock is released
+	if l.KeepPrevious {
+		err = l.keepPrevious()
+	} else {
+		err = l.archive(l.filename(), l.now(), false)
+	}
 	if err != nil {
 		return err
 	}
 
 	err = l.openNewFile()
+	if err != nil && l.useFallback(err) {
+		err = l.openNewFile()
+	}
 	if err != nil {
 		return err
 	}
+	l.chownLike(l.fd, prev)
+	l.rotations++
+	l.lastRotation = l.now()
+	l.mill()
 	return nil
 }
 
-func (l *Logger) composeFile() error {
-	file, err := os.Open(l.Filename)
+// isEmpty reports whether the current file holds nothing but the header.
+// A closed file is checked on disk, against the header it was opened with.
+func (l *Logger) isEmpty() bool {
+	if l.fd != nil {
+		return l.size == l.headerLen
+	}
+	info, err := l.filesystem().Stat(l.filename())
+	return err == nil && info.Size() <= l.headerLen
+}
+
+// archive moves src to a fresh backup name stamped with t, as a hard link
+// if link is set and the filesystem allows it, and queues it for the mill.
+func (l *Logger) archive(src string, t time.Time, link bool) error {
+	backup, err := l.getBackupFileName(t)
+	if err != nil {
+		return err
+	}
+	err = l.filesystem().MkdirAll(filepath.Dir(backup), l.dirPerm())
 	if err != nil {
-		return fmt.Errorf("error in opening file %s ", l.Filename)
+		return fmt.Errorf("error in creating backup directory %s: %v", filepath.Dir(backup), err)
+	}
+	if link {
+		err = l.filesystem().Link(src, backup)
+	}
+	if !link || err != nil {
+		err = l.filesystem().Rename(src, backup)
+	}
+	staged := false
+	if err != nil && absPath(filepath.Dir(src)) != absPath(filepath.Dir(backup)) {
+		// BackupDir may be on another filesystem; the mill copies the
+		// backup over from next to src
+		if l.filesystem().Rename(src, filepath.Join(filepath.Dir(src), filepath.Base(backup))+stageExt) == nil {
+			err, staged = nil, true
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if l.Generations && l.BackupNameFunc == nil {
+		l.gen++
+	}
+	if l.compress() {
+		l.millMu.Lock()
+		l.compressNew++
+		l.millMu.Unlock()
+	}
+	if !l.compress() && !staged && l.OnRotate != nil {
+		l.millMu.Lock()
+		l.renamed = append(l.renamed, backup)
+		l.millMu.Unlock()
+	}
+	return nil
+}
+
+// keepPrevious moves the current file to Filename plus previousExt, turning
+// the file there before into a regular backup stamped with the time it was
+// last written. The old file is linked to its backup name first, so the
+// previous name is replaced in one rename and is never missing.
+func (l *Logger) keepPrevious() error {
+	previous := l.filename() + previousExt
+	info, err := l.filesystem().Stat(previous)
+	switch {
+	case err == nil:
+		err = l.archive(previous, info.ModTime(), true)
+		if err != nil {
+			return err
+		}
+	case !os.IsNotExist(err):
+		return fmt.Errorf("error in getting file %s stat", previous)
+	}
+	return l.filesystem().Rename(l.filename(), previous)
+}
+
+// footerWriter hands PreRotateFunc the current file, keeping the size
+// accounting in step.
+type footerWriter struct {
+	l *Logger
+}
+
+func (w footerWriter) Write(p []byte) (int, error) {
+	n, err := w.l.out().Write(p)
+	w.l.size += int64(n)
+	return n, err
+}
+
+// composeFile compresses the plain backup src into name plus the codec's
+// extension, or the content hash name in its directory, removes src and
+// returns the archive's path. The archive is written to a temporary name and
+// renamed into place once it is complete and synced, so it never exists in a
+// partial state, and src is only removed after that. On failure the
+// temporary file is removed again.
+func (l *Logger) composeFile(src, name string) (dst string, err error) {
+	file, err := l.filesystem().Open(src)
+	if err != nil {
+		return "", fmt.Errorf("error in opening file %s ", src)
 	}
 	defer file.Close()
 
-	fileinfo, err := os.Stat(l.Filename)
+	codec := l.codec()
+	dst = name + codec.Ext()
+	tmp := dst + tmpExt
+	out, err := l.filesystem().OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, l.fileMode())
 	if err != nil {
-		return fmt.Errorf("error in getting file %s stat", l.Filename)
+		return "", fmt.Errorf("error in opening compressed log file %s", tmp)
+	}
+	defer func() {
+		out.Close()
+		if err != nil {
+			_ = l.filesystem().Remove(tmp)
+		}
+	}()
+	if l.PreserveOwner {
+		info, err := file.Stat()
+		if err == nil {
+			l.chownLike(out, info)
+		}
+	}
+
+	// the checksum is of the archive, taken as it is written
+	sum := l.newHash()
+	var w io.Writer = out
+	if sum != nil {
+		w = io.MultiWriter(out, sum)
+	}
+	zw, err := codec.NewWriter(w)
+	if err != nil {
+		return "", err
 	}
 
-	dst := l.getBackupFileName()
-	gzf, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fileinfo.Mode())
+	var r io.Reader = file
+	var content hash.Hash
+	if l.ContentHashNames {
+		content = sha256.New()
+		r = io.TeeReader(file, content)
+	}
+	read, err := l.copyFlushing(zw, r)
+	if err != nil {
+		// release the codec, which for CompressCommand is a running process
+		zw.Close()
+		return "", err
+	}
+	err = zw.Close()
+	if err != nil {
+		return "", err
+	}
+	err = out.Sync()
 	if err != nil {
-		return fmt.Errorf("error in opening compressed log file %s")
+		return "", err
+	}
+	written, err := out.Stat()
+	if err != nil {
+		return "", err
+	}
+	err = out.Close()
+	if err != nil {
+		return "", err
+	}
+	if l.VerifyArchives {
+		err = l.verifyArchive(codec, tmp)
+		if err != nil {
+			return "", err
+		}
+	}
+	duplicate := false
+	if content != nil {
+		hashed := fmt.Sprintf("%x-%s%s", content.Sum(nil), filepath.Base(l.Filename), codec.Ext())
+		dst = filepath.Join(filepath.Dir(name), hashed)
+		duplicate = l.exists(dst)
+	}
+	if duplicate {
+		// the same data is archived already
+		_ = l.filesystem().Remove(tmp)
+	} else {
+		err = l.filesystem().Rename(tmp, dst)
+		if err != nil {
+			return "", err
+		}
+		if sum != nil {
+			err = l.writeChecksum(dst, sum.Sum(nil))
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	// Windows does not remove a file that is still open.
+	file.Close()
+	err = l.filesystem().Remove(src)
+	if err != nil {
+		return "", err
+	}
+	l.millMu.Lock()
+	l.compressedIn += uint64(read)
+	l.compressedOut += uint64(written.Size())
+	l.millMu.Unlock()
+	return dst, nil
+}
+
+// getBackupFileName returns a fresh backup name stamped with t. Backups made
+// within the same second are told apart by a sequence number, so the name
+// never collides with an existing plain or compressed backup. Names from
+// BackupNameFunc are used as they are, and an error is returned if one is
+// already taken.
+func (l *Logger) getBackupFileName(t time.Time) (string, error) {
+	dir := l.backupDir()
+	base := filepath.Base(l.filename())
+	currentTime := t.In(l.location())
+	if l.BackupNameFunc != nil {
+		if l.ParseBackupName == nil {
+			return "", errors.New("BackupNameFunc is set without ParseBackupName")
+		}
+		name := l.backupPath(dir, currentTime, l.BackupNameFunc(l.Filename, currentTime))
+		if l.exists(name) || l.exists(name+l.ext()) {
+			return "", fmt.Errorf("backup %s already exists", name)
+		}
+		return name, nil
+	}
+	stamp := currentTime.Format(l.timeFormat())
+	seq := 0
+	if stamp == l.lastStamp {
+		seq = l.lastSeq + 1
+	}
+	gen := ""
+	if l.Generations {
+		err := l.loadGeneration()
+		if err != nil {
+			return "", err
+		}
+		gen = fmt.Sprintf("g%d-", l.gen+1)
+	}
+	for ; ; seq++ {
+		name := l.backupPath(dir, currentTime, fmt.Sprintf("%s-%d-%s%s", stamp, seq, gen, base))
+		if !l.exists(name) && !l.exists(name+l.ext()) {
+			l.lastStamp, l.lastSeq = stamp, seq
+			return name, nil
+		}
 	}
-	defer gzf.Close()
+}
 
-	gz := gzip.NewWriter(gzf)
+// backupPath places the backup called name in dir, or where BackupPathFunc
+// puts it below dir.
+func (l *Logger) backupPath(dir string, t time.Time, name string) string {
+	if l.BackupPathFunc != nil {
+		name = l.BackupPathFunc(t, name)
+	}
+	return filepath.Join(dir, name)
+}
 
-	_, err = io.Copy(gz, file)
+func (l *Logger) exists(name string) bool {
+	_, err := l.filesystem().Lstat(name)
+	return !os.IsNotExist(err)
+}
+
+// Open opens the log file right away instead of on the first Write, so
+// that a bad path or missing permissions show at startup. It does nothing if
+// the file is already open.
+func (l *Logger) Open() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.fd != nil {
+		return nil
+	}
+	return l.prepare(0, 0)
+}
+
+// Rotate archives the current log file and opens a fresh file in its place.
+// An empty file is archived too, unless SkipEmpty is set.
+func (l *Logger) Rotate() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if _, err := l.filesystem().Stat(l.filename()); os.IsNotExist(err) {
+		err = l.close()
+		if err != nil {
+			return err
+		}
+		return l.openNewFile()
+	}
+	return l.makeNewFile()
+}
+
+// CompressFile compresses the plain file path, for instance one left behind
+// by an earlier run, into an archive named and placed like a backup stamped
+// with the current time, removes path and returns the archive's path. From
+// then on retention manages the archive like any other. The active file is
+// refused.
+func (l *Logger) CompressFile(path string) (string, error) {
+	abs := absPath(path)
+	if abs == absPath(l.Filename) || abs == absPath(l.filename()) {
+		return "", fmt.Errorf("refusing to compress the active log file %s", path)
+	}
+	l.mu.Lock()
+	backup, err := l.getBackupFileName(l.now())
+	if err == nil && l.Generations && l.BackupNameFunc == nil {
+		l.gen++
+	}
+	l.mu.Unlock()
 	if err != nil {
-		return err
+		return "", err
 	}
-	err = gz.Close()
+	err = l.filesystem().MkdirAll(filepath.Dir(backup), l.dirPerm())
 	if err != nil {
-		return err
+		return "", fmt.Errorf("error in creating backup directory %s: %v", filepath.Dir(backup), err)
+	}
+	// the plain file never appears under the backup name, so the mill
+	// cannot pick it up while it is being compressed
+	dst, err := l.composeFile(path, backup)
+	if err != nil {
+		return "", fmt.Errorf("error in compressing %s: %v", path, err)
 	}
-	err = os.Remove(l.Filename)
+	l.mill()
+	return dst, nil
+}
+
+// Reopen closes the current log file and opens Filename again, appending to
+// it if it exists. It is meant for external rotation tools such as logrotate
+// that rename the file and signal the process, typically with SIGHUP.
+// Reopen never archives or compresses anything itself.
+func (l *Logger) Reopen() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	err := l.close()
 	if err != nil {
 		return err
 	}
-	return nil
+	return l.appendFile()
+}
+
+// Reset empties the current log file in place, opening or creating it first
+// if needed, without archiving anything. Data still buffered is discarded.
+// Unlike Rotate it keeps no history, which suits clearing a log between test
+// cases.
+func (l *Logger) Reset() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.fd == nil {
+		err := l.appendFile()
+		if err != nil {
+			return err
+		}
+	}
+	l.settle(true)
+	if l.buf != nil {
+		l.buf.Reset(l.fd)
+	}
+	// the file is in append mode, so writes continue at the new end
+	err := l.fd.Truncate(0)
+	if err != nil {
+		return fmt.Errorf("error in truncating file %s: %v", l.filename(), err)
+	}
+	l.size = 0
+	l.lines = 0
+	l.preallocate(l.fd)
+	l.openTime = l.now()
+	return l.writeHeader()
+}
+
+// FileName returns the path being written to, which differs from Filename
+// once the Logger has moved to FallbackDir.
+func (l *Logger) FileName() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.filename()
+}
+
+// SetMaxSize changes MaxSize while the Logger is in use. If the current
+// file is already over the new limit, the next Write rotates it first.
+// MaxSizeBytes, when set, still takes precedence.
+func (l *Logger) SetMaxSize(mb int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.MaxSize = mb
+}
+
+// SetMaxBackups changes MaxBackups while the Logger is in use and applies it
+// in the background.
+func (l *Logger) SetMaxBackups(n int) {
+	l.millMu.Lock()
+	l.MaxBackups = n
+	l.millMu.Unlock()
+	l.mill()
+}
+
+// SetMaxAge changes MaxAge while the Logger is in use and applies it in the
+// background.
+func (l *Logger) SetMaxAge(days int) {
+	l.millMu.Lock()
+	l.MaxAge = days
+	l.millMu.Unlock()
+	l.mill()
+}
+
+// Sync commits the current log file to stable storage.
+func (l *Logger) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.fd == nil {
+		return nil
+	}
+	return l.sync()
 }
 
-func (l *Logger) getBackupFileName() string {
-	dir := filepath.Dir(l.Filename)
-	base := filepath.Base(l.Filename)
-	currentTime := time.Now()
-	return filepath.Join(dir, fmt.Sprintf("%s-%d-%s%s", currentTime.Format(timeFormat), currentTime.Nanosecond(), base, ext))
+func (l *Logger) sync() error {
+	l.settle(true)
+	if l.buf != nil {
+		err := l.buf.Flush()
+		if err != nil {
+			return err
+		}
+	}
+	return l.fd.Sync()
+}
+
+// Close closes the current log file and waits for pending compressions to
+// finish. A later Write reopens the file.
+func (l *Logger) Close() error {
+	l.mu.Lock()
+	err := l.close()
+	stopTicker := l.detachTicker()
+	l.mu.Unlock()
+	stopTicker()
+	unregister(l)
+	l.waitMill()
+	return err
+}
+
+// Shutdown closes the current log file and waits for pending background
+// compressions and cleanups, giving up with ctx.Err() when ctx is done first.
+func (l *Logger) Shutdown(ctx context.Context) error {
+	l.mu.Lock()
+	err := l.close()
+	stopTicker := l.detachTicker()
+	l.mu.Unlock()
+	stopTicker()
+	unregister(l)
+
+	done := make(chan struct{})
+	go func() {
+		l.waitMill()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (l *Logger) close() error {
 	if l.fd == nil {
 		return nil
 	}
-	err := l.fd.Close()
+	l.settle(true)
+	var err error
+	if l.buf != nil {
+		err = l.buf.Flush()
+	}
+	if l.Preallocate && err == nil {
+		err = l.trim()
+	}
+	if cerr := l.fd.Close(); err == nil {
+		err = cerr
+	}
 	l.fd = nil
 	return err
 }
 
-func (l *Logger) max() int {
+// trim releases the space preallocated past the end of the file, so that
+// it is not kept for the backup.
+func (l *Logger) trim() error {
+	fileinfo, err := l.fd.Stat()
+	if err != nil {
+		return fmt.Errorf("error in getting file %s stat", l.filename())
+	}
+	return l.fd.Truncate(fileinfo.Size())
+}
+
+// setFile makes file the current log file, wrapping it in the write buffer
+// when BufferSize is set.
+func (l *Logger) setFile(file file) {
+	l.fd = file
+	if l.fromNew {
+		register(l)
+	}
+	// however the file came to be opened, timed flushes and rotation run
+	// from now on
+	l.startTicker()
+	if l.BufferSize <= 0 {
+		return
+	}
+	if l.buf == nil {
+		l.buf = bufio.NewWriterSize(file, l.BufferSize)
+	} else {
+		l.buf.Reset(file)
+	}
+}
+
+// out is where writes go: the buffer if there is one, else the file.
+func (l *Logger) out() interface {
+	io.Writer
+	io.StringWriter
+} {
+	if l.buf != nil {
+		return l.buf
+	}
+	return l.fd
+}
+
+func (l *Logger) now() time.Time {
+	if l.clock == nil {
+		return time.Now()
+	}
+	return l.clock()
+}
+
+func (l *Logger) period() time.Duration {
+	if l.RotationPeriod > 0 {
+		return l.RotationPeriod
+	}
+	if l.Daily {
+		return 24 * time.Hour
+	}
+	return 0
+}
+
+// periodChanged reports whether the current file was opened in an earlier
+// rotation period than now.
+func (l *Logger) periodChanged() bool {
+	period := l.period()
+	if period <= 0 {
+		return false
+	}
+	return !periodStart(l.openTime, period).Equal(periodStart(l.now(), period))
+}
+
+// periodStart returns the start of the period containing t. Periods that
+// divide a day are counted on the wall clock from midnight in t's location,
+// so a day with a daylight saving change still starts at midnight; longer
+// ones are aligned to midnight at t's zone offset rather than to UTC.
+func periodStart(t time.Time, period time.Duration) time.Time {
+	if 24*time.Hour%period != 0 {
+		_, offset := t.Zone()
+		shift := time.Duration(offset) * time.Second
+		return t.Add(shift).Truncate(period).Add(-shift)
+	}
+	return periodBoundary(t, period, int64(wallClock(t)/period))
+}
+
+// nextPeriod returns the start of the period after the one containing t.
+func nextPeriod(t time.Time, period time.Duration) time.Time {
+	if 24*time.Hour%period != 0 {
+		return periodStart(t, period).Add(period)
+	}
+	k := int64(wallClock(t)/period) + 1
+	next := periodBoundary(t, period, k)
+	// the wall clock repeats itself when daylight saving time ends
+	for !next.After(t) {
+		k++
+		next = periodBoundary(t, period, k)
+	}
+	return next
+}
+
+// wallClock returns the time of day of t as shown on the clock.
+func wallClock(t time.Time) time.Duration {
+	h, m, s := t.Clock()
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute +
+		time.Duration(s)*time.Second + time.Duration(t.Nanosecond())
+}
+
+// periodBoundary returns the time the clock shows k periods after midnight
+// on the day of t.
+func periodBoundary(t time.Time, period time.Duration, k int64) time.Time {
+	y, m, d := t.Date()
+	off := time.Duration(k) * period
+	return time.Date(y, m, d, 0, 0, int(off/time.Second), int(off%time.Second), t.Location())
+}
+
+// filename returns the path of the log file, which is in FallbackDir once
+// the Logger has fallen back to it.
+func (l *Logger) filename() string {
+	l.millMu.Lock()
+	defer l.millMu.Unlock()
+	if l.fallback != "" {
+		return l.fallback
+	}
+	return l.Filename
+}
+
+// useFallback switches to FallbackDir after the log file could not be
+// opened with err, reporting whether there is a new location to retry.
+func (l *Logger) useFallback(err error) bool {
+	if l.FallbackDir == "" || errors.Is(err, ErrLocked) {
+		return false
+	}
+	path := filepath.Join(l.FallbackDir, filepath.Base(l.Filename))
+	l.millMu.Lock()
+	switched := l.fallback == ""
+	l.fallback = path
+	l.millMu.Unlock()
+	if switched {
+		l.report(fmt.Errorf("falling back to %s: %v", path, err))
+	}
+	return switched
+}
+
+// compress reports whether backups are compressed.
+func (l *Logger) compress() bool {
+	return !l.DisableCompression
+}
+
+// timeFormat returns the layout of the stamp in backup names.
+func (l *Logger) timeFormat() string {
+	if l.TimeFormat == "" {
+		return timeFormat
+	}
+	return l.TimeFormat
+}
+
+// location returns the time zone of backup names.
+func (l *Logger) location() *time.Location {
+	switch {
+	case l.Location != nil:
+		return l.Location
+	case l.UTC:
+		return time.UTC
+	}
+	return time.Local
+}
+
+func (l *Logger) backupDir() string {
+	if l.BackupDir == "" {
+		return filepath.Dir(l.filename())
+	}
+	return l.BackupDir
+}
+
+// openFlags adds the flags implied by the configuration to those of an
+// open of the log file.
+func (l *Logger) openFlags(flag int) int {
+	if l.WriteThrough {
+		flag |= os.O_SYNC
+	}
+	return flag
+}
+
+func (l *Logger) dirPerm() os.FileMode {
+	if l.DirPerm == 0 {
+		return defaultDirPerm
+	}
+	return l.DirPerm
+}
+
+func (l *Logger) fileMode() os.FileMode {
+	if l.FileMode == 0 {
+		return defaultFileMode
+	}
+	return l.FileMode
+}
+
+func (l *Logger) compressionLevel() int {
+	if l.CompressionLevel < gzip.BestSpeed || l.CompressionLevel > gzip.BestCompression {
+		return gzip.DefaultCompression
+	}
+	return l.CompressionLevel
+}
+
+// maxWrite returns the largest write accepted, if there is a limit.
+func (l *Logger) maxWrite() (int64, bool) {
+	if l.MaxLineSize > 0 {
+		return int64(l.MaxLineSize), true
+	}
+	if l.AllowOversized {
+		return 0, false
+	}
+	return l.max(), true
+}
+
+func (l *Logger) max() int64 {
+	if l.MaxSizeBytes > 0 {
+		return l.MaxSizeBytes
+	}
 	if l.MaxSize == 0 {
 		return defaultMaxSize * megabyte
 	}
-	return l.MaxSize * megabyte
+	return int64(l.MaxSize) * megabyte
 }
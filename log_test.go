@@ -0,0 +1,642 @@
+package rollinglogger
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tempDir returns a fresh directory and a function removing it again.
+func tempDir(t *testing.T) (string, func()) {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "rollinglogger")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func writeString(t *testing.T, l *Logger, s string) {
+	t.Helper()
+	if _, err := l.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// fileNames lists dir, sorted.
+func fileNames(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Name())
+	}
+	sort.Strings(names)
+	return names
+}
+
+// within fails the test if f does not return in time, which here means a
+// deadlock.
+func within(t *testing.T, timeout time.Duration, f func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		f()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		t.Fatal("timed out, probably deadlocked")
+	}
+}
+
+func TestOnRotateMayCloseAndFlush(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	calls := make(chan string, 4)
+	var l *Logger
+	l, err := New(filepath.Join(dir, "a.log"), func(l *Logger) {
+		l.OnRotate = func(path string) {
+			l.Flush()
+			l.Close()
+			calls <- path
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	writeString(t, l, "one\n")
+	within(t, 5*time.Second, func() {
+		if err := l.Rotate(); err != nil {
+			t.Error(err)
+		}
+		path := <-calls
+		if filepath.Ext(path) != ".gz" {
+			t.Errorf("OnRotate got %s, want the archive", path)
+		}
+		if err := l.Close(); err != nil {
+			t.Error(err)
+		}
+		if err := l.Flush(); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestZeroValueCompresses(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	l := &Logger{Filename: filepath.Join(dir, "a.log")}
+	defer l.Close()
+	writeString(t, l, "one\n")
+	if err := l.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	backups, err := l.Backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 || !backups[0].Compressed {
+		t.Errorf("backups %+v, want one compressed backup", backups)
+	}
+}
+
+func TestWithCompressionFalse(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	l, err := New(filepath.Join(dir, "a.log"), WithCompression(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	writeString(t, l, "one\n")
+	if err := l.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	backups, err := l.Backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 || backups[0].Compressed {
+		t.Errorf("backups %+v, want one plain backup", backups)
+	}
+}
+
+func TestRotateEmptyFile(t *testing.T) {
+	for _, tt := range []struct {
+		skip, header, closed bool
+	}{
+		{false, false, false},
+		{true, false, false},
+		{true, true, false},
+		{false, false, true},
+		{true, false, true},
+		{true, true, true},
+	} {
+		dir, cleanup := tempDir(t)
+		l := &Logger{Filename: filepath.Join(dir, "a.log"), SkipEmpty: tt.skip}
+		if tt.header {
+			l.Header = []byte("# header\n")
+		}
+		if err := l.Open(); err != nil {
+			t.Fatal(err)
+		}
+		if tt.closed {
+			l.Close()
+		}
+		if err := l.Rotate(); err != nil {
+			t.Fatalf("%+v: %v", tt, err)
+		}
+		if err := l.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		backups, err := l.Backups()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := 1
+		if tt.skip {
+			want = 0
+		}
+		if len(backups) != want {
+			t.Errorf("%+v: %d backups of an empty file, want %d", tt, len(backups), want)
+		}
+		if _, err := os.Stat(l.Filename); err != nil {
+			t.Errorf("%+v: %v", tt, err)
+		}
+		l.Close()
+		cleanup()
+	}
+}
+
+func TestFileMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes are not enforced on Windows")
+	}
+	for _, mode := range []os.FileMode{0, 0600, 0640} {
+		want := mode
+		if want == 0 {
+			want = 0644
+		}
+		dir, cleanup := tempDir(t)
+		l := &Logger{Filename: filepath.Join(dir, "a.log"), FileMode: mode}
+		writeString(t, l, "one\n")
+		if err := l.Rotate(); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		backups, err := l.Backups()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(backups) != 1 {
+			t.Fatalf("backups %+v, want one", backups)
+		}
+		for _, path := range []string{l.Filename, backups[0].Path} {
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := info.Mode().Perm(); got != want {
+				t.Errorf("FileMode %o: %s has mode %o, want %o", mode, filepath.Base(path), got, want)
+			}
+		}
+		l.Close()
+		cleanup()
+	}
+}
+
+func TestRotateTightLoop(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	// a frozen clock puts every rotation in the same second
+	now := time.Now()
+	l := &Logger{Filename: filepath.Join(dir, "a.log"), clock: func() time.Time { return now }}
+	defer l.Close()
+	const n = 200
+	for i := 0; i < n; i++ {
+		writeString(t, l, fmt.Sprintf("line %d\n", i))
+		if err := l.Rotate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	backups, err := l.Backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != n {
+		t.Fatalf("%d backups after %d rotations", len(backups), n)
+	}
+	seen := make(map[string]bool)
+	for _, b := range backups {
+		f, err := os.Open(b.Path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(zr)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[string(data)] = true
+	}
+	if len(seen) != n {
+		t.Errorf("%d distinct archives after %d rotations", len(seen), n)
+	}
+}
+
+func TestRotateAtLargeSize(t *testing.T) {
+	const max = 5 << 30 // past what an int32 holds
+	for _, tt := range []struct {
+		size   int64
+		rotate bool
+	}{
+		{3 << 30, false},
+		{max - 10, true},
+	} {
+		dir, cleanup := tempDir(t)
+		filename := filepath.Join(dir, "a.log")
+		if err := ioutil.WriteFile(filename, []byte("old\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		fsys := &testFS{}
+		opened := false
+		fsys.openFile = func(name string, flag int, perm os.FileMode) (file, error) {
+			f, err := fsys.osFS.OpenFile(name, flag, perm)
+			if err != nil || opened {
+				return f, err
+			}
+			// the existing file claims to be huge
+			opened = true
+			return &hookFile{file: f, stat: func() (os.FileInfo, error) {
+				info, err := f.Stat()
+				return sizedInfo{info, tt.size}, err
+			}}, nil
+		}
+		l := &Logger{Filename: filename, MaxSizeBytes: max, DisableCompression: true, fsys: fsys}
+		writeString(t, l, "0123456789\n")
+		if err := l.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		backups, err := l.Backups()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rotated := len(backups) == 1; rotated != tt.rotate {
+			t.Errorf("size %d: %d backups, want rotation %v", tt.size, len(backups), tt.rotate)
+		}
+		want := tt.size + 11
+		if tt.rotate {
+			want = 11
+		}
+		if l.size != want {
+			t.Errorf("size %d: file has size %d, want %d", tt.size, l.size, want)
+		}
+		l.Close()
+		cleanup()
+	}
+}
+
+func TestShortWrite(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	fsys := &testFS{}
+	fsys.openFile = func(name string, flag int, perm os.FileMode) (file, error) {
+		f, err := fsys.osFS.OpenFile(name, flag, perm)
+		if err != nil {
+			return nil, err
+		}
+		// the disk takes only the first four bytes of every write
+		return &hookFile{file: f, write: func(p []byte) (int, error) {
+			if len(p) <= 4 {
+				return f.Write(p)
+			}
+			n, _ := f.Write(p[:4])
+			return n, io.ErrShortWrite
+		}}, nil
+	}
+	l := &Logger{Filename: filepath.Join(dir, "a.log"), fsys: fsys}
+	defer l.Close()
+
+	n, err := l.Write([]byte("0123456789\n"))
+	if err == nil {
+		t.Fatal("short write succeeded")
+	}
+	if n != 4 {
+		t.Errorf("short write returned %d, want 4", n)
+	}
+	writeString(t, l, "abc\n")
+	data, err := ioutil.ReadFile(l.Filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "0123abc\n" {
+		t.Errorf("file holds %q", data)
+	}
+	if l.size != int64(len(data)) {
+		t.Errorf("size is %d, file has %d bytes", l.size, len(data))
+	}
+}
+
+func TestCompressionFailureLeavesNoArchive(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	fsys := &testFS{}
+	fsys.open = func(name string) (file, error) {
+		f, err := fsys.osFS.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		// reading the backup fails part way through
+		read := 0
+		return &hookFile{file: f, read: func(p []byte) (int, error) {
+			if read > 0 {
+				return 0, errors.New("read failed")
+			}
+			if len(p) > 1000 {
+				p = p[:1000]
+			}
+			n, err := f.Read(p)
+			read += n
+			return n, err
+		}}, nil
+	}
+	l := &Logger{Filename: filepath.Join(dir, "a.log"), fsys: fsys}
+	defer l.Close()
+	writeString(t, l, string(logData(64<<10)))
+	if err := l.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Flush(); err == nil {
+		t.Fatal("compression succeeded")
+	}
+	backups, err := l.Backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 || backups[0].Compressed || backups[0].Size != 64<<10 {
+		t.Errorf("backups %+v, want the complete plain backup", backups)
+	}
+	for _, name := range fileNames(t, dir) {
+		if strings.Contains(name, ".gz") {
+			t.Errorf("stray archive %s", name)
+		}
+	}
+}
+
+func TestWriteThrough(t *testing.T) {
+	for _, through := range []bool{false, true} {
+		dir, cleanup := tempDir(t)
+		fsys := &testFS{}
+		// without compression, only the log file itself is opened for writing
+		l := &Logger{Filename: filepath.Join(dir, "a.log"), WriteThrough: through, DisableCompression: true, fsys: fsys}
+		writeString(t, l, "one\n")
+		if err := l.Rotate(); err != nil {
+			t.Fatal(err)
+		}
+		writeString(t, l, "two\n")
+		// appending after a Close
+		l.Close()
+		writeString(t, l, "three\n")
+		l.Close()
+
+		flags := fsys.openFlags()
+		if len(flags) < 3 {
+			t.Errorf("WriteThrough %v: %d opens, want appends and new files", through, len(flags))
+		}
+		for _, flag := range flags {
+			if got := flag&os.O_SYNC == os.O_SYNC; got != through {
+				t.Errorf("WriteThrough %v: opened with flags %#x", through, flag)
+			}
+		}
+		cleanup()
+	}
+}
+
+func TestRotateAtOpen(t *testing.T) {
+	const max = minMaxSizeBytes
+	tests := []struct {
+		existing, write int
+		rotate          bool
+	}{
+		{0, 1, false},
+		{max - 2, 1, false},
+		{max - 1, 1, true}, // the write would fill it exactly
+		{max, 1, true},
+		{max + 100, 1, true}, // MaxSize was lowered since
+		{10, max - 10, true},
+		{10, max - 11, false},
+	}
+	for _, tt := range tests {
+		dir, cleanup := tempDir(t)
+		filename := filepath.Join(dir, "a.log")
+		if err := ioutil.WriteFile(filename, bytes.Repeat([]byte("x"), tt.existing), 0644); err != nil {
+			t.Fatal(err)
+		}
+		l := &Logger{Filename: filename, MaxSizeBytes: max, DisableCompression: true}
+		writeString(t, l, strings.Repeat("y", tt.write))
+		if err := l.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		backups, err := l.Backups()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rotated := len(backups) > 0; rotated != tt.rotate {
+			t.Errorf("file of %d bytes, write of %d: rotated %v, want %v", tt.existing, tt.write, rotated, tt.rotate)
+		}
+		l.Close()
+		cleanup()
+	}
+}
+
+func TestRotateBySize(t *testing.T) {
+	record := strings.Repeat("x", 1023) + "\n"
+	tests := []struct {
+		name         string
+		maxSize      int
+		maxSizeBytes int64
+		writes       int
+		backups      int
+		max          int64
+	}{
+		{"300 KB", 0, 300 << 10, 1000, 3, 300 << 10},
+		{"bytes over MB", 1, 300 << 10, 1000, 3, 300 << 10},
+		{"1 MB", 1, 0, 1100, 1, 1 << 20},
+	}
+	for _, tt := range tests {
+		dir, cleanup := tempDir(t)
+		l := &Logger{
+			Filename:           filepath.Join(dir, "a.log"),
+			MaxSize:            tt.maxSize,
+			MaxSizeBytes:       tt.maxSizeBytes,
+			DisableCompression: true,
+		}
+		for i := 0; i < tt.writes; i++ {
+			writeString(t, l, record)
+		}
+		if err := l.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		backups, err := l.Backups()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(backups) != tt.backups {
+			t.Errorf("%s: %d backups, want %d", tt.name, len(backups), tt.backups)
+		}
+		for _, b := range backups {
+			// every backup is as full as whole records allow
+			if b.Size > tt.max || b.Size <= tt.max-int64(len(record)) {
+				t.Errorf("%s: backup of %d bytes", tt.name, b.Size)
+			}
+		}
+		l.Close()
+		cleanup()
+	}
+}
+
+func TestReadFromSplitsFiles(t *testing.T) {
+	for _, header := range []string{"", "# header\n"} {
+		dir, cleanup := tempDir(t)
+		l := &Logger{
+			Filename:           filepath.Join(dir, "a.log"),
+			MaxSizeBytes:       minMaxSizeBytes,
+			Header:             []byte(header),
+			DisableCompression: true,
+		}
+		data := logData(5*minMaxSizeBytes + 100)
+		n, err := l.ReadFrom(bytes.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != int64(len(data)) {
+			t.Errorf("header %q: ReadFrom returned %d, want %d", header, n, len(data))
+		}
+		l.Close()
+
+		// backups sort oldest first by name, before the live file
+		names := fileNames(t, dir)
+		if len(names) != 6 {
+			t.Errorf("header %q: %d files, want 6", header, len(names))
+		}
+		var got []byte
+		for i, name := range names {
+			content := readLog(t, filepath.Join(dir, name))
+			if len(content) > minMaxSizeBytes {
+				t.Errorf("header %q: %s has %d bytes", header, name, len(content))
+			}
+			if i < len(names)-1 && len(content) != minMaxSizeBytes {
+				t.Errorf("header %q: %s has %d bytes, want it full", header, name, len(content))
+			}
+			if !strings.HasPrefix(content, header) {
+				t.Errorf("header %q: %s does not start with the header", header, name)
+			}
+			got = append(got, content[len(header):]...)
+		}
+		if !bytes.Equal(got, data) {
+			t.Errorf("header %q: files do not hold the stream in order", header)
+		}
+		cleanup()
+	}
+}
+
+func TestWriteString(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	l := &Logger{Filename: filepath.Join(dir, "a.log"), MaxSizeBytes: minMaxSizeBytes, DisableCompression: true}
+	defer l.Close()
+	line := strings.Repeat("x", 999) + "\n"
+	for i := 0; i < 5; i++ {
+		n, err := l.WriteString(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len(line) {
+			t.Errorf("WriteString returned %d, want %d", n, len(line))
+		}
+	}
+	if err := l.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// four lines fit, the fifth starts a new file
+	backups, err := l.Backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 || backups[0].Size != int64(4*len(line)) {
+		t.Errorf("backups %+v, want one of %d bytes", backups, 4*len(line))
+	}
+	if l.size != int64(len(line)) {
+		t.Errorf("current file has %d bytes, want %d", l.size, len(line))
+	}
+}
+
+func TestTeeGetsOnlyWrittenRecords(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	fsys := &testFS{}
+	var broken bool
+	fsys.openFile = func(name string, flag int, perm os.FileMode) (file, error) {
+		if broken {
+			return nil, errors.New("open failed")
+		}
+		return fsys.osFS.OpenFile(name, flag, perm)
+	}
+	var tee bytes.Buffer
+	l := &Logger{Filename: filepath.Join(dir, "a.log"), MemoryBufferSize: 1024, Tee: &tee, fsys: fsys}
+	defer l.Close()
+
+	writeString(t, l, "one\n")
+	l.Close()
+	broken = true
+	// the file cannot be opened, so these wait in memory
+	writeString(t, l, "two\n")
+	writeString(t, l, "three\n")
+	if got := tee.String(); got != "one\n" {
+		t.Errorf("tee got %q while records were held in memory", got)
+	}
+	broken = false
+	writeString(t, l, "four\n")
+	if got, want := tee.String(), "one\ntwo\nthree\nfour\n"; got != want {
+		t.Errorf("tee got %q, want %q", got, want)
+	}
+	data, err := ioutil.ReadFile(l.Filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != tee.String() {
+		t.Errorf("file holds %q, tee got %q", data, tee.String())
+	}
+}
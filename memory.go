@@ -0,0 +1,71 @@
+package rollinglogger
+
+import "errors"
+
+// memoryBuffer holds records that could not be written while the file was
+// unavailable, oldest first, up to MemoryBufferSize bytes.
+type memoryBuffer struct {
+	records [][]byte
+	size    int
+	drops   uint64 // records discarded to make room
+}
+
+// push adds a record, discarding the oldest ones until it fits. A record
+// larger than the whole buffer is discarded itself.
+func (m *memoryBuffer) push(p []byte, limit int) {
+	if len(p) > limit {
+		m.drops++
+		return
+	}
+	for m.size+len(p) > limit {
+		m.size -= len(m.records[0])
+		m.records = m.records[1:]
+		m.drops++
+	}
+	m.records = append(m.records, p)
+	m.size += len(p)
+}
+
+// writeRecord writes a record of size bytes like write, but keeps it in
+// the memory buffer if the file cannot be opened or written. rest returns a
+// copy of the record from offset n. Records stay in order: while older ones
+// are still buffered, new ones are buffered behind them. A buffered record
+// goes to Tee once it is written out.
+func (l *Logger) writeRecord(size int64, lines int, w func(off int) (int, error), rest func(n int) []byte, tee func()) (int, error) {
+	if l.MemoryBufferSize <= 0 {
+		return l.write(size, lines, w, tee)
+	}
+	if !l.drainMemory() {
+		l.mem.push(rest(0), l.MemoryBufferSize)
+		return int(size), nil
+	}
+	n, err := l.write(size, lines, w, tee)
+	if err != nil && !errors.Is(err, ErrWriteTooLarge) && !errors.Is(err, ErrWriteTimeout) {
+		l.mem.push(rest(n), l.MemoryBufferSize)
+		return int(size), nil
+	}
+	return n, err
+}
+
+// drainMemory writes out the memory buffer, reporting whether it is empty
+// now.
+func (l *Logger) drainMemory() bool {
+	for len(l.mem.records) > 0 {
+		rec := l.mem.records[0]
+		n, err := l.write(int64(len(rec)), l.linesIn(rec), func(off int) (int, error) {
+			return l.out().Write(rec[off:])
+		}, l.teeBytes(rec))
+		if errors.Is(err, ErrWriteTooLarge) {
+			// the limits changed since it was buffered; it will never fit
+			l.mem.drops++
+			n = len(rec)
+		} else if err != nil {
+			l.mem.records[0] = rec[n:]
+			l.mem.size -= n
+			return false
+		}
+		l.mem.records = l.mem.records[1:]
+		l.mem.size -= n
+	}
+	return true
+}
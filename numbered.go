@@ -0,0 +1,86 @@
+package rollinglogger
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// NamingScheme selects how backups are named.
+type NamingScheme int
+
+const (
+	// NamingTimestamp names backups <stamp>-<seq>-<name>.
+	NamingTimestamp NamingScheme = iota
+	// NamingNumbered names backups <name>.1, <name>.2 and so on, newest
+	// first, in the style of logrotate.
+	NamingNumbered
+)
+
+// parseNumbered returns the number of name if it is a numbered backup of
+// base.
+func parseNumbered(name, base string) (int, bool) {
+	if !strings.HasPrefix(name, base+".") {
+		return 0, false
+	}
+	n, err := strconv.Atoi(name[len(base)+1:])
+	if err != nil || n < 1 || strconv.Itoa(n) != name[len(base)+1:] {
+		return 0, false
+	}
+	return n, true
+}
+
+// renumber gives the backups rotated since the last pass, which still carry
+// timestamped names, the lowest numbers and shifts the numbered ones up to
+// make room. Every move goes to a higher number, so working from the highest
+// down never overwrites a backup. It runs on the mill goroutine, before any
+// compression of the pass.
+func (l *Logger) renumber() error {
+	backups, err := l.listBackups()
+	if err != nil {
+		return err
+	}
+	shift := 0
+	for _, b := range backups {
+		if b.num == 0 {
+			shift++
+		}
+	}
+	if shift == 0 {
+		return nil
+	}
+	// Filename.1 is the previous file with KeepPrevious, so backups start
+	// at 2
+	first := 1
+	if l.KeepPrevious {
+		first = 2
+	}
+	// listBackups puts the timestamped ones first, newest first
+	for i := range backups {
+		if backups[i].num == 0 {
+			backups[i].num = i + first
+		} else {
+			backups[i].num += shift
+		}
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].num > backups[j].num
+	})
+	base := filepath.Base(l.filename())
+	for _, b := range backups {
+		target := filepath.Join(filepath.Dir(b.path), fmt.Sprintf("%s.%d", base, b.num))
+		if b.compressed {
+			target += l.ext()
+		}
+		if target == b.path {
+			continue
+		}
+		err = l.filesystem().Rename(b.path, target)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package rollinglogger
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// readLog returns the content of path, decompressing archives.
+func readLog(t *testing.T, path string) string {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if filepath.Ext(path) == ".gz" {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = zr
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestNumberedKeepPrevious(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	l, err := New(filepath.Join(dir, "a.log"), func(l *Logger) {
+		l.NamingScheme = NamingNumbered
+		l.KeepPrevious = true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for i := 1; i <= 4; i++ {
+		writeString(t, l, fmt.Sprintf("file %d\n", i))
+		if err := l.Rotate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeString(t, l, "file 5\n")
+	if err := l.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"a.log", "a.log.1", "a.log.2.gz", "a.log.3.gz", "a.log.4.gz"}
+	if got := fileNames(t, dir); !reflect.DeepEqual(got, want) {
+		t.Fatalf("directory holds %v, want %v", got, want)
+	}
+	for i, name := range want {
+		if got, want := readLog(t, filepath.Join(dir, name)), fmt.Sprintf("file %d\n", 5-i); got != want {
+			t.Errorf("%s holds %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestNumberedKeepPreviousMaxBackups(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	l, err := New(filepath.Join(dir, "a.log"), WithMaxBackups(2), func(l *Logger) {
+		l.NamingScheme = NamingNumbered
+		l.KeepPrevious = true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for i := 0; i < 5; i++ {
+		writeString(t, l, "line\n")
+		if err := l.Rotate(); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the previous file does not count as a backup
+	want := []string{"a.log", "a.log.1", "a.log.2.gz", "a.log.3.gz"}
+	if got := fileNames(t, dir); !reflect.DeepEqual(got, want) {
+		t.Errorf("directory holds %v, want %v", got, want)
+	}
+}
+
+func TestNumbered(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	l, err := New(filepath.Join(dir, "a.log"), WithMaxBackups(3), func(l *Logger) {
+		l.NamingScheme = NamingNumbered
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for i := 1; i <= 5; i++ {
+		writeString(t, l, fmt.Sprintf("file %d\n", i))
+		if err := l.Rotate(); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeString(t, l, "file 6\n")
+
+	want := []string{"a.log", "a.log.1", "a.log.2.gz", "a.log.3.gz"}
+	if got := fileNames(t, dir); !reflect.DeepEqual(got, want) {
+		t.Fatalf("directory holds %v, want %v", got, want)
+	}
+	for i, name := range want {
+		if got, want := readLog(t, filepath.Join(dir, name)), fmt.Sprintf("file %d\n", 6-i); got != want {
+			t.Errorf("%s holds %q, want %q", name, got, want)
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package rollinglogger
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Option configures a Logger created by New.
+type Option func(*Logger)
+
+// New returns a Logger writing to filename, configured by opts, and registers
+// it for CloseAll. Filename and BackupDir are made absolute, so a later change
+// of the working directory does not move the files. A Logger built directly
+// as a struct literal remains valid; New only adds validation, registration
+// and path resolution.
+func New(filename string, opts ...Option) (*Logger, error) {
+	l := &Logger{
+		Filename: filename,
+		MaxSize:  defaultMaxSize,
+	}
+	for _, opt := range opts {
+		opt(l)
+	}
+	// MaxSize starts out at the default, so zero here was asked for
+	// explicitly and is most likely a configuration mistake
+	if l.MaxSize == 0 {
+		return nil, errors.New("max size must be positive")
+	}
+	err := l.Validate()
+	if err != nil {
+		return nil, err
+	}
+	l.Filename, err = filepath.Abs(l.Filename)
+	if err != nil {
+		return nil, fmt.Errorf("error in resolving path %s: %v", filename, err)
+	}
+	if l.BackupDir != "" {
+		l.BackupDir, err = filepath.Abs(l.BackupDir)
+		if err != nil {
+			return nil, fmt.Errorf("error in resolving path %s: %v", l.BackupDir, err)
+		}
+	}
+	if l.Generations {
+		err = l.loadGeneration()
+		if err != nil {
+			return nil, err
+		}
+	}
+	l.fromNew = true
+	register(l)
+	return l, nil
+}
+
+// NewInDir is like New for the file basename in dir, which is created if
+// needed. A relative BackupDir is taken relative to dir.
+func NewInDir(dir, basename string, opts ...Option) (*Logger, error) {
+	if basename == "" {
+		return nil, errors.New("empty log filename")
+	}
+	opts = append(opts[:len(opts):len(opts)], func(l *Logger) {
+		if l.BackupDir != "" && !filepath.IsAbs(l.BackupDir) {
+			l.BackupDir = filepath.Join(dir, l.BackupDir)
+		}
+	})
+	l, err := New(filepath.Join(dir, basename), opts...)
+	if err != nil {
+		return nil, err
+	}
+	err = l.filesystem().MkdirAll(dir, l.dirPerm())
+	if err != nil {
+		unregister(l)
+		return nil, fmt.Errorf("error in creating directory %s: %v", dir, err)
+	}
+	return l, nil
+}
+
+// Validate reports the first problem with l's configuration. Zero values are
+// valid and select the defaults, so a MaxSize of 0 means 100 MB.
+func (l *Logger) Validate() error {
+	switch {
+	case l.Filename == "":
+		return errors.New("empty log filename")
+	case l.MaxSize < 0:
+		return fmt.Errorf("negative max size %d", l.MaxSize)
+	case l.MaxSizeBytes < 0:
+		return fmt.Errorf("negative max size bytes %d", l.MaxSizeBytes)
+	case l.MaxSizeBytes > 0 && l.MaxSizeBytes < minMaxSizeBytes:
+		return fmt.Errorf("max size bytes %d below the minimum of %d", l.MaxSizeBytes, minMaxSizeBytes)
+	case l.MaxBackups < 0:
+		return fmt.Errorf("negative max backups %d", l.MaxBackups)
+	case l.MaxAge < 0:
+		return fmt.Errorf("negative max age %d", l.MaxAge)
+	case l.MaxTotalSize < 0:
+		return fmt.Errorf("negative max total size %d", l.MaxTotalSize)
+	case l.MaxTotalSize > 0 && l.MaxSizeBytes > 0 && int64(l.MaxTotalSize)*megabyte < l.MaxSizeBytes:
+		return fmt.Errorf("max total size %d MB smaller than max size %d bytes", l.MaxTotalSize, l.MaxSizeBytes)
+	case l.MaxTotalSize > 0 && l.MaxSizeBytes == 0 && l.MaxTotalSize < l.MaxSize:
+		return fmt.Errorf("max total size %d MB smaller than max size %d MB", l.MaxTotalSize, l.MaxSize)
+	case l.KeepUncompressed < 0:
+		return fmt.Errorf("negative keep uncompressed %d", l.KeepUncompressed)
+	case l.MaxConcurrentCompressions < 0:
+		return fmt.Errorf("negative max concurrent compressions %d", l.MaxConcurrentCompressions)
+	case l.BackpressureThreshold < 0:
+		return fmt.Errorf("negative backpressure threshold %d", l.BackpressureThreshold)
+	case l.MinFreeDiskPercent < 0 || l.MinFreeDiskPercent >= 100:
+		return fmt.Errorf("min free disk percent %d out of range", l.MinFreeDiskPercent)
+	case l.CompressFlushBytes < 0:
+		return fmt.Errorf("negative compress flush bytes %d", l.CompressFlushBytes)
+	case l.MaxLines < 0:
+		return fmt.Errorf("negative max lines %d", l.MaxLines)
+	case l.MaxLineSize < 0:
+		return fmt.Errorf("negative max line size %d", l.MaxLineSize)
+	case l.MemoryBufferSize < 0:
+		return fmt.Errorf("negative memory buffer size %d", l.MemoryBufferSize)
+	case l.BufferSize < 0:
+		return fmt.Errorf("negative buffer size %d", l.BufferSize)
+	case l.RotationPeriod < 0:
+		return fmt.Errorf("negative rotation period %v", l.RotationPeriod)
+	case l.CleanupInterval < 0:
+		return fmt.Errorf("negative cleanup interval %v", l.CleanupInterval)
+	case l.FlushInterval < 0:
+		return fmt.Errorf("negative flush interval %v", l.FlushInterval)
+	case l.WriteTimeout < 0:
+		return fmt.Errorf("negative write timeout %v", l.WriteTimeout)
+	case l.Codec != nil && len(l.CompressCommand) > 0:
+		return errors.New("both Codec and CompressCommand are set")
+	case l.TimeFormat != "" && !safeTimeFormat(l.TimeFormat):
+		return fmt.Errorf("time format %q does not give usable backup names", l.TimeFormat)
+	case l.NamingScheme == NamingNumbered && (l.BackupNameFunc != nil || l.BackupPathFunc != nil ||
+		l.ContentHashNames || l.Generations || l.Checksum != ChecksumNone):
+		return errors.New("numbered backup names do not combine with custom names, content hash names, generations or checksums")
+	case l.Generations && l.ContentHashNames:
+		return errors.New("both Generations and ContentHashNames are set")
+	case l.BackupNameFunc != nil && l.ParseBackupName == nil:
+		return errors.New("BackupNameFunc is set without ParseBackupName")
+	case l.collides():
+		return fmt.Errorf("log filename %s looks like one of its own backups", l.Filename)
+	}
+	return nil
+}
+
+// collides reports whether Filename would be recognized as one of its own
+// backups if it were not excluded by name.
+func (l *Logger) collides() bool {
+	if absPath(l.backupDir()) != absPath(filepath.Dir(l.Filename)) {
+		return false
+	}
+	_, ok := l.parseBackupName(filepath.Base(l.Filename))
+	return ok
+}
+
+// safeTimeFormat reports whether layout stamps names without path
+// separators, or colons on Windows, and parses back to the time it stamped.
+func safeTimeFormat(layout string) bool {
+	t := time.Date(2006, 11, 22, 15, 34, 56, 0, time.UTC)
+	stamp := t.Format(layout)
+	bad := "/\\"
+	if runtime.GOOS == "windows" {
+		bad += ":"
+	}
+	if stamp == "" || strings.ContainsAny(stamp, bad) {
+		return false
+	}
+	// a layout missing part of the date or time would give every backup
+	// the wrong age
+	parsed, err := time.ParseInLocation(layout, stamp, time.UTC)
+	return err == nil && parsed.Equal(t)
+}
+
+// WithMaxSize sets the size in megabytes at which the log file is rotated.
+func WithMaxSize(mb int) Option {
+	return func(l *Logger) {
+		l.MaxSize = mb
+	}
+}
+
+// WithMaxSizeBytes sets the size in bytes at which the log file is rotated,
+// overriding WithMaxSize.
+func WithMaxSizeBytes(n int64) Option {
+	return func(l *Logger) {
+		l.MaxSizeBytes = n
+	}
+}
+
+// WithMaxBackups sets how many backups are retained.
+func WithMaxBackups(n int) Option {
+	return func(l *Logger) {
+		l.MaxBackups = n
+	}
+}
+
+// WithMaxAge sets how many days backups are retained.
+func WithMaxAge(days int) Option {
+	return func(l *Logger) {
+		l.MaxAge = days
+	}
+}
+
+// WithMaxTotalSize sets the combined size in megabytes backups may occupy.
+func WithMaxTotalSize(mb int) Option {
+	return func(l *Logger) {
+		l.MaxTotalSize = mb
+	}
+}
+
+// WithBackupDir sets the directory backups are kept in.
+func WithBackupDir(dir string) Option {
+	return func(l *Logger) {
+		l.BackupDir = dir
+	}
+}
+
+// WithBackupNames sets a custom backup naming scheme and its parser.
+func WithBackupNames(name func(filename string, t time.Time) string, parse func(name string) (time.Time, bool)) Option {
+	return func(l *Logger) {
+		l.BackupNameFunc = name
+		l.ParseBackupName = parse
+	}
+}
+
+// WithCompression sets whether rotated files are gzipped.
+func WithCompression(compress bool) Option {
+	return func(l *Logger) {
+		l.DisableCompression = !compress
+	}
+}
+
+// WithRotationPeriod sets the period after which the file is also rotated.
+func WithRotationPeriod(period time.Duration) Option {
+	return func(l *Logger) {
+		l.RotationPeriod = period
+	}
+}
+
+// WithDaily sets whether the file is also rotated once per calendar day.
+func WithDaily(daily bool) Option {
+	return func(l *Logger) {
+		l.Daily = daily
+	}
+}
+
+// WithUTC sets whether backup names are stamped in UTC.
+func WithUTC(utc bool) Option {
+	return func(l *Logger) {
+		l.UTC = utc
+	}
+}
+
+// WithLocation sets the time zone backup names are stamped in.
+func WithLocation(loc *time.Location) Option {
+	return func(l *Logger) {
+		l.Location = loc
+	}
+}
+
+// WithTimeFormat sets the time layout of the stamp in backup names.
+func WithTimeFormat(layout string) Option {
+	return func(l *Logger) {
+		l.TimeFormat = layout
+	}
+}
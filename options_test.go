@@ -0,0 +1,153 @@
+package rollinglogger
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMaxSizeLimits(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	filename := filepath.Join(dir, "a.log")
+	tests := []struct {
+		name string
+		opts []Option
+		ok   bool
+	}{
+		{"default", nil, true},
+		{"explicit zero", []Option{WithMaxSize(0)}, false},
+		{"negative", []Option{WithMaxSize(-1)}, false},
+		{"one MB", []Option{WithMaxSize(1)}, true},
+		{"negative bytes", []Option{WithMaxSizeBytes(-1)}, false},
+		{"bytes below the minimum", []Option{WithMaxSizeBytes(minMaxSizeBytes - 1)}, false},
+		{"bytes at the minimum", []Option{WithMaxSizeBytes(minMaxSizeBytes)}, true},
+		{"one byte", []Option{WithMaxSizeBytes(1)}, false},
+	}
+	for _, tt := range tests {
+		l, err := New(filename, tt.opts...)
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("%s: New returned %v", tt.name, err)
+		}
+		if l != nil {
+			l.Close()
+		}
+	}
+}
+
+func TestZeroMaxSizeIsDefault(t *testing.T) {
+	l := &Logger{Filename: "a.log"}
+	if err := l.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if got := l.max(); got != defaultMaxSize*megabyte {
+		t.Errorf("zero MaxSize rotates at %d bytes, want %d", got, defaultMaxSize*megabyte)
+	}
+	l.MaxSizeBytes = minMaxSizeBytes
+	if got := l.max(); got != minMaxSizeBytes {
+		t.Errorf("MaxSizeBytes %d rotates at %d bytes", minMaxSizeBytes, got)
+	}
+}
+
+func TestNewFreezesRelativePath(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	logs, other := filepath.Join(dir, "logs"), filepath.Join(dir, "other")
+	for _, d := range []string{logs, other} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chdir(logs); err != nil {
+		t.Fatal(err)
+	}
+	l, err := New("a.log", WithBackupDir("old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if err := os.Chdir(other); err != nil {
+		t.Fatal(err)
+	}
+
+	writeString(t, l, "one\n")
+	if err := l.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	writeString(t, l, "two\n")
+	if err := l.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if names := fileNames(t, other); len(names) != 0 {
+		t.Errorf("new working directory holds %v", names)
+	}
+	if names := fileNames(t, logs); !reflect.DeepEqual(names, []string{"a.log", "old"}) {
+		t.Errorf("log directory holds %v", names)
+	}
+	if names := fileNames(t, filepath.Join(logs, "old")); len(names) != 1 {
+		t.Errorf("backup directory holds %v, want one archive", names)
+	}
+}
+
+func TestSafeTimeFormat(t *testing.T) {
+	for layout, ok := range map[string]bool{
+		timeFormat:             true,
+		"20060102T150405":      true,
+		"2006-01-02T15-04-05Z": true,
+		"15-04-05":             false, // no date
+		"2006-01-02":           false, // no time
+		"2006-01-02-03-04-05":  false, // 12 hour clock without AM/PM
+		"2006/01/02-15-04-05":  false, // path separator
+		"":                     false,
+	} {
+		if got := safeTimeFormat(layout); got != ok {
+			t.Errorf("safeTimeFormat(%q) = %v, want %v", layout, got, ok)
+		}
+	}
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	if _, err := New(filepath.Join(dir, "a.log"), WithTimeFormat("15-04-05")); err == nil {
+		t.Error("New accepted a time format without a date")
+	}
+}
+
+func TestRetentionWithTimeFormat(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	const layout = "20060102T150405"
+	now := time.Now().UTC()
+	old := now.Add(-30*24*time.Hour).Format(layout) + "-0-a.log.gz"
+	if err := ioutil.WriteFile(filepath.Join(dir, old), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	l, err := New(filepath.Join(dir, "a.log"), WithTimeFormat(layout), WithUTC(true), WithMaxAge(7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	writeString(t, l, "one\n")
+	if err := l.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	backups, err := l.Backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 || filepath.Base(backups[0].Path) == old {
+		t.Fatalf("backups %+v, want only the new one", backups)
+	}
+	if age := now.Sub(backups[0].Time); age < -time.Minute || age > time.Minute {
+		t.Errorf("new backup is dated %v", backups[0].Time)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package rollinglogger
+
+import "os"
+
+// chownLike is a no-op where files have no uid/gid to preserve.
+func (l *Logger) chownLike(f file, info os.FileInfo) {}
@@ -0,0 +1,31 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package rollinglogger
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// chownLike gives f the owner of info when PreserveOwner is set. Failures,
+// typically for lack of privileges, are reported on Errors and otherwise
+// ignored.
+func (l *Logger) chownLike(f file, info os.FileInfo) {
+	if !l.PreserveOwner || info == nil {
+		return
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	c, ok := f.(interface{ Chown(uid, gid int) error })
+	if !ok {
+		return
+	}
+	err := c.Chown(int(st.Uid), int(st.Gid))
+	if err != nil {
+		l.report(fmt.Errorf("error in preserving owner of %s: %v", info.Name(), err))
+	}
+}
@@ -0,0 +1,25 @@
+package rollinglogger
+
+import (
+	"fmt"
+	"syscall"
+)
+
+const fallocKeepSize = 0x1
+
+// preallocate reserves MaxSize bytes for a new file without changing its
+// size. Failures, among them a disk too full to hold the file, are reported
+// on Errors.
+func (l *Logger) preallocate(f file) {
+	if !l.Preallocate {
+		return
+	}
+	fd, ok := f.(interface{ Fd() uintptr })
+	if !ok {
+		return
+	}
+	err := syscall.Fallocate(int(fd.Fd()), fallocKeepSize, 0, l.max())
+	if err != nil && err != syscall.EOPNOTSUPP {
+		l.report(fmt.Errorf("error in preallocating file %s: %v", l.filename(), err))
+	}
+}
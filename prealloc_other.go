@@ -0,0 +1,7 @@
+//go:build !linux
+// +build !linux
+
+package rollinglogger
+
+// preallocate is a no-op where fallocate is not available.
+func (l *Logger) preallocate(f file) {}
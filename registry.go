@@ -0,0 +1,60 @@
+package rollinglogger
+
+import (
+	"strings"
+	"sync"
+)
+
+// registry holds the Loggers from New that are open or not yet used. Close
+// takes a Logger out, and reopening it puts it back.
+var registry struct {
+	mu      sync.Mutex
+	loggers map[*Logger]struct{}
+}
+
+func register(l *Logger) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	if registry.loggers == nil {
+		registry.loggers = make(map[*Logger]struct{})
+	}
+	registry.loggers[l] = struct{}{}
+}
+
+func unregister(l *Logger) {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	delete(registry.loggers, l)
+}
+
+// CloseAll closes every open Logger created by New, for use from a single
+// shutdown point. It returns all Close failures combined into one error.
+func CloseAll() error {
+	registry.mu.Lock()
+	loggers := make([]*Logger, 0, len(registry.loggers))
+	for l := range registry.loggers {
+		loggers = append(loggers, l)
+	}
+	registry.mu.Unlock()
+
+	var errs multiError
+	for _, l := range loggers {
+		if err := l.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+type multiError []error
+
+func (m multiError) Error() string {
+	msgs := make([]string, len(m))
+	for i, err := range m {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
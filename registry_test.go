@@ -0,0 +1,77 @@
+package rollinglogger
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+func registered(l *Logger) bool {
+	registry.mu.Lock()
+	defer registry.mu.Unlock()
+	_, ok := registry.loggers[l]
+	return ok
+}
+
+func TestCloseUnregisters(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	for i := 0; i < 100; i++ {
+		l, err := New(filepath.Join(dir, "a.log"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeString(t, l, "line\n")
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if registered(l) {
+			t.Fatal("closed Logger still registered")
+		}
+	}
+}
+
+func TestReopenRegistersAgain(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	l, err := New(filepath.Join(dir, "a.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if !registered(l) {
+		t.Fatal("new Logger not registered")
+	}
+	l.Close()
+	writeString(t, l, "line\n")
+	if !registered(l) {
+		t.Fatal("reopened Logger not registered")
+	}
+	if err := CloseAll(); err != nil {
+		t.Fatal(err)
+	}
+	if registered(l) {
+		t.Fatal("Logger still registered after CloseAll")
+	}
+}
+
+func TestFailedNewInDirNotRegistered(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	file := filepath.Join(dir, "file")
+	if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	registry.mu.Lock()
+	before := len(registry.loggers)
+	registry.mu.Unlock()
+	if _, err := NewInDir(filepath.Join(file, "logs"), "a.log"); err == nil {
+		t.Fatal("NewInDir below a file succeeded")
+	}
+	registry.mu.Lock()
+	after := len(registry.loggers)
+	registry.mu.Unlock()
+	if after != before {
+		t.Errorf("registry grew from %d to %d Loggers", before, after)
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+// +build !windows
+
+package rollinglogger
+
+import "os"
+
+func removeFile(name string) error {
+	return os.Remove(name)
+}
+
+func renameFile(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
@@ -0,0 +1,43 @@
+package rollinglogger
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+const (
+	errorSharingViolation syscall.Errno = 32
+	errorLockViolation    syscall.Errno = 33
+	fileOpRetries                       = 5
+	fileOpBackoff                       = 10 * time.Millisecond
+)
+
+// removeFile removes name, retrying with a growing backoff while another
+// process (a virus scanner, a tailing reader) still holds it open.
+func removeFile(name string) error {
+	return retryInUse(func() error { return os.Remove(name) })
+}
+
+// renameFile renames oldpath, retrying like removeFile.
+func renameFile(oldpath, newpath string) error {
+	return retryInUse(func() error { return os.Rename(oldpath, newpath) })
+}
+
+func retryInUse(op func() error) error {
+	delay := fileOpBackoff
+	for i := 0; ; i++ {
+		err := op()
+		if err == nil || i == fileOpRetries || !inUse(err) {
+			return err
+		}
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func inUse(err error) bool {
+	var errno syscall.Errno
+	return errors.As(err, &errno) && (errno == errorSharingViolation || errno == errorLockViolation)
+}
@@ -0,0 +1,672 @@
+package rollinglogger
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type backupFile struct {
+	path       string
+	t          time.Time
+	seq        int
+	gen        int // generation number, 0 if the name has none
+	num        int // number with NamingNumbered, 0 for a timestamped name
+	size       int64
+	compressed bool
+}
+
+// mill schedules compression of plain backups and a retention pass in the
+// background so that Write does not wait on gzip or directory scans.
+// Requests made while one is already queued are coalesced into it.
+func (l *Logger) mill() {
+	l.sendMill(nil)
+}
+
+// millSync runs a mill pass on the background goroutine and waits for its
+// result, so it never races with a pass started by rotation.
+func (l *Logger) millSync() error {
+	done := make(chan error, 1)
+	l.sendMill(done)
+	return <-done
+}
+
+// sendMill queues a mill pass, starting the mill goroutine if it is not
+// running. A nil done is dropped if a pass is already queued; otherwise the
+// pass's result is delivered on done.
+func (l *Logger) sendMill(done chan error) {
+	l.initMill()
+	l.millMu.Lock()
+	defer l.millMu.Unlock()
+	if done == nil && len(l.millQueue) > 0 {
+		return
+	}
+	l.millQueue = append(l.millQueue, done)
+	l.millPending++
+	if !l.millRunning {
+		l.millRunning = true
+		go l.millRun()
+	}
+}
+
+// initMill prepares the mill state the first time it is needed.
+func (l *Logger) initMill() {
+	l.startMill.Do(func() {
+		l.millCond = sync.NewCond(&l.millMu)
+	})
+}
+
+// waitBacklog blocks while BackpressureThreshold or more backups are waiting
+// for or in compression.
+func (l *Logger) waitBacklog() {
+	limit := l.BackpressureThreshold
+	if limit <= 0 {
+		limit = defaultBacklog
+	}
+	l.initMill()
+	l.millMu.Lock()
+	defer l.millMu.Unlock()
+	for l.compressNew+l.compressQueue+l.compressActive >= limit {
+		l.millCond.Wait()
+	}
+}
+
+// millRun works through the queued mill requests and exits once there are
+// none left, so an idle or closed Logger holds no goroutine.
+func (l *Logger) millRun() {
+	l.millMu.Lock()
+	for len(l.millQueue) > 0 {
+		done := l.millQueue[0]
+		l.millQueue = l.millQueue[1:]
+		l.millMu.Unlock()
+
+		err := l.millRunOnce(done != nil)
+		if done != nil {
+			done <- err
+		}
+
+		l.millMu.Lock()
+		if err != nil && done == nil && len(l.millErrs) < errorBufferSize {
+			l.millErrs = append(l.millErrs, err)
+		}
+		l.millPending--
+		l.millCond.Broadcast()
+	}
+	l.millRunning = false
+	l.millMu.Unlock()
+}
+
+// Flush waits until all pending background compressions and cleanups are
+// done and returns the errors they ran into since the last Flush. Unlike
+// Shutdown it leaves the file open, and unlike Sync it does not touch the
+// active file at all.
+func (l *Logger) Flush() error {
+	err := l.millSync()
+	l.millMu.Lock()
+	errs := multiError(l.millErrs)
+	l.millErrs = nil
+	l.millMu.Unlock()
+	if err != nil {
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// Cleanup compresses plain backups left behind, for instance by a crash in
+// the middle of a rotation, and applies the retention limits. It is safe to
+// call at any time and never touches the active file. The first Write does
+// the same in the background.
+func (l *Logger) Cleanup() error {
+	return l.millSync()
+}
+
+// waitMill blocks until every scheduled mill run has completed and OnRotate
+// has been called for its backups. It does not wait while a callback is
+// running, which may be the caller itself.
+func (l *Logger) waitMill() {
+	l.millMu.Lock()
+	defer l.millMu.Unlock()
+	for l.millPending > 0 || !l.notifying && len(l.notifyQueue) > 0 {
+		l.millCond.Wait()
+	}
+}
+
+// millRunOnce runs a mill pass. Retention is skipped if the last one was
+// less than CleanupInterval ago, unless force is set.
+func (l *Logger) millRunOnce(force bool) error {
+	l.millMu.Lock()
+	renamed := l.renamed
+	l.renamed = nil
+	l.millMu.Unlock()
+	for _, path := range renamed {
+		l.notifyRotate(path)
+	}
+
+	var (
+		errMu    sync.Mutex
+		firstErr error
+	)
+	fail := func(err error) {
+		l.report(err)
+		errMu.Lock()
+		if firstErr == nil {
+			firstErr = err
+		}
+		errMu.Unlock()
+	}
+
+	if err := l.moveStaged(); err != nil {
+		fail(err)
+	}
+	if l.NamingScheme == NamingNumbered {
+		err := l.renumber()
+		if err != nil {
+			fail(fmt.Errorf("error in renumbering backups of %s: %v", l.Filename, err))
+			return firstErr
+		}
+	}
+
+	now := l.now()
+	due := force || l.CleanupInterval <= 0 || l.lastCleanup.IsZero() ||
+		!now.Before(l.lastCleanup.Add(l.CleanupInterval))
+	if !due && !l.compress() {
+		return nil
+	}
+
+	// the scan finds every backup rotated so far; the backlog is counted
+	// from what it returns
+	l.millMu.Lock()
+	l.compressNew = 0
+	l.millMu.Unlock()
+	backups, err := l.listBackups()
+	if err != nil {
+		fail(err)
+		return firstErr
+	}
+
+	if l.compress() {
+		l.compressBackups(backups, fail)
+	}
+
+	count := len(backups)
+	if due {
+		l.lastCleanup = now
+		for _, b := range l.expired(backups) {
+			if err := l.removeBackup(b.path); err != nil && !os.IsNotExist(err) {
+				fail(err)
+				continue
+			}
+			if l.BackupPathFunc != nil {
+				l.removeEmptyDirs(filepath.Dir(b.path))
+			}
+			count--
+		}
+	}
+	l.millMu.Lock()
+	l.backupCount = count
+	l.millMu.Unlock()
+	return firstErr
+}
+
+// BackupInfo describes a backup on disk.
+type BackupInfo struct {
+	Path       string
+	Time       time.Time // rotation time embedded in the name, else the modification time
+	Size       int64
+	Compressed bool
+}
+
+// Backups returns the existing backups of the log file, newest first. It
+// recognizes backups exactly as retention does.
+func (l *Logger) Backups() ([]BackupInfo, error) {
+	backups, err := l.listBackups()
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]BackupInfo, len(backups))
+	for i, b := range backups {
+		infos[i] = BackupInfo{
+			Path:       b.path,
+			Time:       b.t,
+			Size:       b.size,
+			Compressed: b.compressed,
+		}
+	}
+	return infos, nil
+}
+
+// PruneCandidates returns the backups the current retention settings would
+// delete, oldest last, without deleting anything.
+func (l *Logger) PruneCandidates() ([]string, error) {
+	backups, err := l.listBackups()
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, b := range l.expired(backups) {
+		paths = append(paths, b.path)
+	}
+	return paths, nil
+}
+
+// compressBackups compresses the plain backups among backups, updating them
+// in place, with at most MaxConcurrentCompressions running at once.
+func (l *Logger) compressBackups(backups []backupFile, fail func(error)) {
+	// backups are newest first, so the first few stay plain
+	var todo []int
+	for i := len(backups) - 1; i >= l.keepUncompressed(); i-- {
+		if !backups[i].compressed {
+			todo = append(todo, i)
+		}
+	}
+	l.millMu.Lock()
+	l.compressQueue = len(todo)
+	l.millMu.Unlock()
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, l.maxCompressions())
+	for _, i := range todo {
+		sem <- struct{}{}
+		l.millMu.Lock()
+		l.compressQueue--
+		l.compressActive++
+		l.millMu.Unlock()
+		wg.Add(1)
+		go func(b *backupFile) {
+			defer wg.Done()
+			dst, err := l.composeFile(b.path, b.path)
+			l.millMu.Lock()
+			l.compressActive--
+			l.millCond.Broadcast()
+			l.millMu.Unlock()
+			<-sem
+			if err != nil {
+				fail(fmt.Errorf("error in compressing %s: %v", b.path, err))
+				return
+			}
+			b.path = dst
+			b.compressed = true
+			if fileinfo, err := l.filesystem().Stat(b.path); err == nil {
+				b.size = fileinfo.Size()
+			}
+			l.notifyRotate(b.path)
+		}(&backups[i])
+	}
+	wg.Wait()
+}
+
+// keepUncompressed returns how many of the newest backups stay plain.
+// Numbered names keep Filename.1 plain, as logrotate's delaycompress does,
+// unless KeepPrevious already holds the newest file there.
+func (l *Logger) keepUncompressed() int {
+	if l.NamingScheme == NamingNumbered && !l.KeepPrevious && l.KeepUncompressed < 1 {
+		return 1
+	}
+	return l.KeepUncompressed
+}
+
+func (l *Logger) maxCompressions() int {
+	if l.MaxConcurrentCompressions <= 0 {
+		return 1
+	}
+	return l.MaxConcurrentCompressions
+}
+
+// notifyRotate queues path for OnRotate. The callbacks run on a goroutine
+// of their own, so one that calls Close or Flush does not wait for itself.
+func (l *Logger) notifyRotate(path string) {
+	if l.OnRotate == nil {
+		return
+	}
+	l.millMu.Lock()
+	defer l.millMu.Unlock()
+	l.notifyQueue = append(l.notifyQueue, path)
+	if !l.notifyRunning {
+		l.notifyRunning = true
+		go l.notifyRun()
+	}
+}
+
+// notifyRun calls OnRotate for the queued backups, shielding the goroutine
+// from a panicking callback, and exits once the queue is empty.
+func (l *Logger) notifyRun() {
+	l.millMu.Lock()
+	for len(l.notifyQueue) > 0 {
+		path := l.notifyQueue[0]
+		l.notifyQueue = l.notifyQueue[1:]
+		l.notifying = true
+		l.millMu.Unlock()
+
+		func() {
+			defer func() {
+				_ = recover()
+			}()
+			l.OnRotate(path)
+		}()
+
+		l.millMu.Lock()
+		l.notifying = false
+		l.millCond.Broadcast()
+	}
+	l.notifyRunning = false
+	l.millMu.Unlock()
+}
+
+// expired returns the backups, sorted newest first, that fall outside any of
+// the configured retention limits.
+func (l *Logger) expired(backups []backupFile) []backupFile {
+	// SetMaxBackups and SetMaxAge may change these concurrently
+	l.millMu.Lock()
+	maxBackups, maxAge := l.MaxBackups, l.MaxAge
+	l.millMu.Unlock()
+
+	keep := len(backups)
+	if maxBackups > 0 && maxBackups < keep {
+		keep = maxBackups
+	}
+	if maxAge > 0 {
+		cutoff := l.now().Add(-time.Duration(maxAge) * 24 * time.Hour)
+		for i := 0; i < keep; i++ {
+			if backups[i].t.Before(cutoff) {
+				keep = i
+				break
+			}
+		}
+	}
+	if l.MaxTotalSize > 0 {
+		var total int64
+		for i := 0; i < keep; i++ {
+			total += backups[i].size
+			if total > int64(l.MaxTotalSize)*megabyte {
+				keep = i
+				break
+			}
+		}
+	}
+	return backups[keep:]
+}
+
+// listBackups returns the archives of l.Filename, newest first.
+func (l *Logger) listBackups() ([]backupFile, error) {
+	backups, err := l.scanBackups(l.backupDir(), absPath(l.filename()), nil)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		// numbered backups are older than timestamped ones still waiting
+		// for their number, and lower numbers are newer
+		if backups[i].num != backups[j].num {
+			switch {
+			case backups[i].num == 0:
+				return true
+			case backups[j].num == 0:
+				return false
+			}
+			return backups[i].num < backups[j].num
+		}
+		if !backups[i].t.Equal(backups[j].t) {
+			return backups[i].t.After(backups[j].t)
+		}
+		// a restart begins the sequence anew, the generation keeps counting
+		if backups[i].gen != backups[j].gen {
+			return backups[i].gen > backups[j].gen
+		}
+		if backups[i].seq != backups[j].seq {
+			return backups[i].seq > backups[j].seq
+		}
+		return backups[i].path > backups[j].path
+	})
+	return backups, nil
+}
+
+// scanBackups appends the backups in dir to backups, descending into
+// subdirectories when BackupPathFunc is set. A missing dir has none.
+func (l *Logger) scanBackups(dir, active string, backups []backupFile) ([]backupFile, error) {
+	files, err := l.filesystem().ReadDir(dir)
+	if os.IsNotExist(err) {
+		return backups, nil
+	}
+	if err != nil {
+		return backups, err
+	}
+	for _, f := range files {
+		path := filepath.Join(dir, f.Name())
+		if f.IsDir() && l.BackupPathFunc != nil {
+			backups, err = l.scanBackups(path, active, backups)
+			if err != nil {
+				return backups, err
+			}
+			continue
+		}
+		// never treat the live file or an archive being written as a
+		// backup, whatever names a custom parser accepts
+		if !f.Mode().IsRegular() || strings.HasSuffix(f.Name(), tmpExt) ||
+			strings.HasSuffix(f.Name(), checksumExt) {
+			continue
+		}
+		if abs := absPath(path); abs == active || l.KeepPrevious && abs == active+previousExt {
+			continue
+		}
+		b, ok := l.parseBackupName(f.Name())
+		if !ok {
+			continue
+		}
+		if b.t.IsZero() {
+			b.t = f.ModTime()
+		}
+		b.path = path
+		b.size = f.Size()
+		backups = append(backups, b)
+	}
+	return backups, nil
+}
+
+// loadGeneration recovers the generation of the newest backup from the
+// backup directory the first time it is needed.
+func (l *Logger) loadGeneration() error {
+	if l.genLoaded {
+		return nil
+	}
+	backups, err := l.scanBackups(l.backupDir(), absPath(l.filename()), nil)
+	if err != nil {
+		return fmt.Errorf("error in scanning backups of %s: %v", l.Filename, err)
+	}
+	for _, b := range backups {
+		if b.gen > l.gen {
+			l.gen = b.gen
+		}
+	}
+	l.genLoaded = true
+	return nil
+}
+
+// moveStaged brings backups that rotation left next to Filename, because
+// BackupDir is on another filesystem, into BackupDir. They are compressed on
+// the way unless KeepUncompressed keeps new backups plain.
+func (l *Logger) moveStaged() error {
+	dir := filepath.Dir(l.filename())
+	if absPath(dir) == absPath(l.backupDir()) {
+		return nil
+	}
+	files, err := l.filesystem().ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if !f.Mode().IsRegular() || !strings.HasSuffix(f.Name(), stageExt) {
+			continue
+		}
+		name := strings.TrimSuffix(f.Name(), stageExt)
+		b, ok := l.parseBackupName(name)
+		if !ok {
+			continue
+		}
+		src := filepath.Join(dir, f.Name())
+		dst := l.backupPath(l.backupDir(), b.t, name)
+		err = l.filesystem().MkdirAll(filepath.Dir(dst), l.dirPerm())
+		if err != nil {
+			return fmt.Errorf("error in creating backup directory %s: %v", filepath.Dir(dst), err)
+		}
+		now := l.compress() && !b.compressed && l.keepUncompressed() == 0
+		if now {
+			dst, err = l.composeFile(src, dst)
+		} else {
+			err = l.copyFile(src, dst)
+		}
+		if err != nil {
+			return fmt.Errorf("error in moving backup %s to %s: %v", src, l.backupDir(), err)
+		}
+		if now || !l.compress() {
+			l.notifyRotate(dst)
+		}
+	}
+	return nil
+}
+
+// copyFile copies src to dst through a temporary file and removes src.
+func (l *Logger) copyFile(src, dst string) (err error) {
+	in, err := l.filesystem().Open(src)
+	if err != nil {
+		return fmt.Errorf("error in opening file %s ", src)
+	}
+	defer in.Close()
+	tmp := dst + tmpExt
+	out, err := l.filesystem().OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, l.fileMode())
+	if err != nil {
+		return fmt.Errorf("error in opening file %s ", tmp)
+	}
+	defer func() {
+		out.Close()
+		if err != nil {
+			_ = l.filesystem().Remove(tmp)
+		}
+	}()
+	if l.PreserveOwner {
+		if info, err := in.Stat(); err == nil {
+			l.chownLike(out, info)
+		}
+	}
+	_, err = io.Copy(out, in)
+	if err != nil {
+		return err
+	}
+	err = out.Sync()
+	if err != nil {
+		return err
+	}
+	err = out.Close()
+	if err != nil {
+		return err
+	}
+	err = l.filesystem().Rename(tmp, dst)
+	if err != nil {
+		return err
+	}
+	in.Close()
+	return l.filesystem().Remove(src)
+}
+
+// removeEmptyDirs removes dir and its parents up to the backup directory as
+// long as they are empty, cleaning up after BackupPathFunc.
+func (l *Logger) removeEmptyDirs(dir string) {
+	root := absPath(l.backupDir())
+	for {
+		abs := absPath(dir)
+		if abs == root || !strings.HasPrefix(abs, root+string(filepath.Separator)) {
+			return
+		}
+		// Remove fails on a directory that is not empty
+		if l.filesystem().Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+func absPath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+	return abs
+}
+
+// isContentHash reports whether name is <sha256 hex>-base, the name of an
+// archive made with ContentHashNames.
+func isContentHash(name, base string) bool {
+	if !strings.HasSuffix(name, "-"+base) || len(name) != sha256.Size*2+1+len(base) {
+		return false
+	}
+	_, err := hex.DecodeString(name[:sha256.Size*2])
+	return err == nil
+}
+
+// parseBackupName reports whether name is a backup of l.Filename and, if so,
+// returns it with the time, sequence and compression state embedded by
+// getBackupFileName filled in. Custom names are parsed by ParseBackupName.
+func (l *Logger) parseBackupName(name string) (backupFile, bool) {
+	var b backupFile
+	b.compressed = strings.HasSuffix(name, l.ext())
+	name = strings.TrimSuffix(name, l.ext())
+	if l.ContentHashNames && b.compressed && isContentHash(name, filepath.Base(l.Filename)) {
+		// the time is the archive's modification time, set by scanBackups
+		return b, true
+	}
+	if l.NamingScheme == NamingNumbered {
+		if n, ok := parseNumbered(name, filepath.Base(l.Filename)); ok {
+			// the time is the modification time, set by scanBackups
+			b.num = n
+			return b, true
+		}
+	}
+	if l.BackupNameFunc != nil {
+		if l.ParseBackupName == nil {
+			return b, false
+		}
+		t, ok := l.ParseBackupName(name)
+		b.t = t
+		return b, ok
+	}
+	suffix := "-" + filepath.Base(l.Filename)
+	if !strings.HasSuffix(name, suffix) {
+		return b, false
+	}
+	prefix := strings.TrimSuffix(name, suffix)
+	i := strings.LastIndexByte(prefix, '-')
+	if i > 0 && strings.HasPrefix(prefix[i+1:], "g") {
+		gen, err := strconv.Atoi(prefix[i+2:])
+		if err != nil || gen < 1 {
+			return b, false
+		}
+		b.gen = gen
+		prefix = prefix[:i]
+		i = strings.LastIndexByte(prefix, '-')
+	}
+	if i < 1 {
+		return b, false
+	}
+	t, err := time.ParseInLocation(l.timeFormat(), prefix[:i], l.location())
+	if err != nil {
+		return b, false
+	}
+	seq, err := strconv.Atoi(prefix[i+1:])
+	if err != nil || seq < 0 {
+		return b, false
+	}
+	b.t, b.seq = t, seq
+	return b, true
+}
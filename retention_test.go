@@ -0,0 +1,347 @@
+package rollinglogger
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackupDirOnOtherFilesystem(t *testing.T) {
+	for _, compress := range []bool{true, false} {
+		dir, cleanup := tempDir(t)
+		backups := filepath.Join(dir, "archive")
+		fsys := &testFS{}
+		fsys.rename = func(oldpath, newpath string) error {
+			if filepath.Dir(oldpath) != filepath.Dir(newpath) {
+				return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: errors.New("cross-device link")}
+			}
+			return os.Rename(oldpath, newpath)
+		}
+		l, err := New(filepath.Join(dir, "a.log"), WithBackupDir(backups), WithCompression(compress))
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.fsys = fsys
+		for i := 0; i < 3; i++ {
+			writeString(t, l, "line\n")
+			if err := l.Rotate(); err != nil {
+				t.Fatalf("compress %v: rotation %d: %v", compress, i, err)
+			}
+		}
+		if err := l.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		l.Close()
+
+		if names := fileNames(t, dir); len(names) != 2 {
+			t.Errorf("compress %v: log directory holds %v, want only a.log and archive", compress, names)
+		}
+		names := fileNames(t, backups)
+		if len(names) != 3 {
+			t.Errorf("compress %v: backup directory holds %v, want 3 backups", compress, names)
+		}
+		for _, name := range names {
+			if strings.HasSuffix(name, ".gz") != compress {
+				t.Errorf("compress %v: unexpected backup %s", compress, name)
+			}
+		}
+		cleanup()
+	}
+}
+
+// makeBackups creates a backup of dir/a.log for each age before now, named
+// as rotation would have named it, and returns the names newest first.
+func makeBackups(t *testing.T, dir string, now time.Time, ages ...time.Duration) []string {
+	t.Helper()
+	var names []string
+	for _, age := range ages {
+		name := now.Add(-age).UTC().Format(timeFormat) + "-0-a.log.gz"
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte("old\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestRetention(t *testing.T) {
+	now := time.Date(2020, 6, 15, 12, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	tests := []struct {
+		name       string
+		maxBackups int
+		maxAge     int
+		keep       int // number of the newest backups that survive
+	}{
+		{"unlimited", 0, 0, 4},
+		{"MaxBackups", 2, 0, 2},
+		{"MaxAge", 0, 7, 2},
+		{"MaxAge equal to the age of a backup", 0, 3, 2},
+		{"both, MaxBackups stricter", 1, 7, 1},
+		{"both, MaxAge stricter", 3, 2, 1},
+	}
+	for _, tt := range tests {
+		dir, cleanup := tempDir(t)
+		backups := makeBackups(t, dir, now, time.Hour, 3*day, 10*day, 30*day)
+		fsys := &testFS{}
+		l := &Logger{
+			Filename:   filepath.Join(dir, "a.log"),
+			MaxBackups: tt.maxBackups,
+			MaxAge:     tt.maxAge,
+			UTC:        true,
+			clock:      func() time.Time { return now },
+			fsys:       fsys,
+		}
+		if err := l.Cleanup(); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		l.Close()
+
+		want := append([]string(nil), backups[:tt.keep]...)
+		sort.Strings(want)
+		if got := fileNames(t, dir); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: kept %v, want %v", tt.name, got, want)
+		}
+		removed := append([]string(nil), backups[tt.keep:]...)
+		sort.Strings(removed)
+		if got := fsys.removedNames(); len(got)+len(removed) > 0 && !reflect.DeepEqual(got, removed) {
+			t.Errorf("%s: removed %v, want %v", tt.name, got, removed)
+		}
+		cleanup()
+	}
+}
+
+func TestRetentionIgnoresOtherFiles(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	now := time.Date(2020, 6, 15, 12, 0, 0, 0, time.UTC)
+	makeBackups(t, dir, now, 30*24*time.Hour)
+	others := []string{"a.log", "b.log", "2020-01-01-00-00-00-0-b.log.gz", "notes.txt"}
+	for _, name := range others {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	fsys := &testFS{}
+	l := &Logger{
+		Filename: filepath.Join(dir, "a.log"),
+		MaxAge:   1,
+		UTC:      true,
+		clock:    func() time.Time { return now },
+		fsys:     fsys,
+	}
+	if err := l.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+
+	sort.Strings(others)
+	if got := fileNames(t, dir); !reflect.DeepEqual(got, others) {
+		t.Errorf("directory holds %v, want %v", got, others)
+	}
+	if got := fsys.removedNames(); len(got) != 1 {
+		t.Errorf("removed %v, want only the old backup", got)
+	}
+}
+
+// acceptAll parses every name as a backup, the live file's included.
+func acceptAll(name string) (time.Time, bool) {
+	return time.Time{}, true
+}
+
+func TestCollidingNameRejected(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	name := func(filename string, t time.Time) string {
+		return t.Format("20060102150405.000000000") + ".log"
+	}
+	_, err := New(filepath.Join(dir, "a.log"), WithBackupNames(name, acceptAll))
+	if err == nil || !strings.Contains(err.Error(), "looks like one of its own backups") {
+		t.Errorf("New returned %v, want a collision error", err)
+	}
+	// backups kept elsewhere cannot be confused with it
+	l, err := New(filepath.Join(dir, "a.log"), WithBackupNames(name, acceptAll), WithBackupDir(filepath.Join(dir, "old")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+}
+
+func TestCollidingNameKeepsLiveFile(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	n := 0
+	// a struct literal is not validated, so the collision gets through
+	l := &Logger{
+		Filename:   filepath.Join(dir, "a.log"),
+		MaxBackups: 1,
+		BackupNameFunc: func(filename string, t time.Time) string {
+			n++
+			return fmt.Sprintf("backup-%d", n)
+		},
+		ParseBackupName: acceptAll,
+	}
+	defer l.Close()
+	for i := 0; i < 3; i++ {
+		writeString(t, l, fmt.Sprintf("line %d\n", i))
+		if err := l.Rotate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeString(t, l, "live\n")
+	if err := l.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(l.Filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "live\n" {
+		t.Errorf("live file holds %q", data)
+	}
+	backups, err := l.Backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 {
+		t.Errorf("backups %+v, want one left by MaxBackups", backups)
+	}
+}
+
+func TestGenerationsRecovered(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	old := []string{
+		"2020-01-01-00-00-00-0-g14-a.log.gz",
+		"2020-01-02-00-00-00-0-g15-a.log",
+		"2020-01-03-00-00-00-0-g99-b.log.gz", // another log's
+	}
+	for _, name := range old {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	generations := func(l *Logger) {
+		l.Generations = true
+		l.DisableCompression = true
+	}
+	l, err := New(filepath.Join(dir, "a.log"), generations)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	for _, want := range []string{"-g16-", "-g17-", "-g18-"} {
+		if want == "-g18-" {
+			// a restart picks up from the backups of the previous run
+			l.Close()
+			l, err = New(filepath.Join(dir, "a.log"), generations)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		writeString(t, l, "line\n")
+		if err := l.Rotate(); err != nil {
+			t.Fatal(err)
+		}
+		// the count survives closing the file
+		l.Close()
+		if err := l.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		backups, err := l.Backups()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(backups) == 0 || !strings.Contains(filepath.Base(backups[0].Path), want) {
+			t.Errorf("newest backup %+v, want generation %s", backups, want)
+		}
+	}
+}
+
+func TestClosedLoggersLeaveNoGoroutines(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	before := runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		l, err := New(filepath.Join(dir, fmt.Sprintf("%d.log", i)), func(l *Logger) {
+			l.OnRotate = func(string) {}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		writeString(t, l, "one\n")
+		if err := l.Rotate(); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if err := l.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the goroutines exit right after their last request is answered
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before+2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n > before+2 {
+		t.Errorf("%d goroutines after closing 50 Loggers, %d before", n, before)
+	}
+}
+
+func TestInterruptedCompressionIgnored(t *testing.T) {
+	dir, cleanup := tempDir(t)
+	defer cleanup()
+	// a crash during compression leaves the plain backup and the partial
+	// archive behind; another partial archive has lost its plain backup
+	plain := "2020-01-02-00-00-00-0-a.log"
+	partial := plain + ".gz" + tmpExt
+	orphan := "2020-01-01-00-00-00-0-a.log.gz" + tmpExt
+	for name, data := range map[string]string{plain: "old\n", partial: "partial", orphan: "orphan"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l := &Logger{Filename: filepath.Join(dir, "a.log"), MaxBackups: 1, UTC: true}
+	defer l.Close()
+	// the first write looks for leftovers and compresses the backup again,
+	// over its partial archive
+	writeString(t, l, "new\n")
+	if err := l.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	backups, err := l.Backups()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 1 || filepath.Base(backups[0].Path) != plain+".gz" {
+		t.Errorf("backups %+v, want only %s.gz", backups, plain)
+	}
+	if got := readLog(t, filepath.Join(dir, plain+".gz")); got != "old\n" {
+		t.Errorf("archive holds %q", got)
+	}
+	if got, want := fileNames(t, dir), []string{orphan, plain + ".gz", "a.log"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("directory holds %v, want %v", got, want)
+	}
+
+	// retention drops every backup but never a temporary file
+	l.MaxAge = 1
+	if err := l.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := fileNames(t, dir), []string{orphan, "a.log"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("directory holds %v, want %v", got, want)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dir, orphan)); err != nil || string(data) != "orphan" {
+		t.Errorf("temporary file changed: %q, %v", data, err)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build go1.21
+// +build go1.21
+
+package rollinglogger
+
+import "log/slog"
+
+// NewSlogHandler returns a slog.Handler that writes records to l as JSON
+// lines. Each record reaches l in a single Write call, so a Logger always
+// rotates between records and never splits one across files.
+func NewSlogHandler(l RollingWriter, opts *slog.HandlerOptions) slog.Handler {
+	return slog.NewJSONHandler(l, opts)
+}
@@ -0,0 +1,81 @@
+package rollinglogger
+
+import "time"
+
+// Stats is a snapshot of a Logger's counters.
+type Stats struct {
+	CurrentSize         int64     // bytes in the active file
+	TotalRotations      uint64    // rotations since the Logger was created
+	TotalBytesWritten   uint64    // bytes accepted by Write and WriteString
+	BackupCount         int       // backups on disk as of the last cleanup pass
+	LastRotation        time.Time // zero if the Logger has not rotated yet
+	DroppedErrors       uint64    // background errors dropped because Errors was full
+	DiskFullDrops       uint64    // writes discarded under DiskFullDrop
+	DiskLow             bool      // free space was below MinFreeDiskPercent when last read
+	WriteTimeouts       uint64    // writes that failed or were dropped for WriteTimeout
+	DroppedWrites       uint64    // failed or dropped writes, including ones held in memory
+	FailedBytes         uint64    // bytes of those writes that did not reach the file
+	MemoryBuffered      int       // bytes held by MemoryBufferSize until the file is usable
+	MemoryDrops         uint64    // records discarded from the full memory buffer
+	CompressionQueue    int       // backups waiting to be compressed
+	CompressionsRunning int       // compressions in progress
+	UncompressedBytes   uint64    // size of the backups compressed so far
+	ArchiveBytes        uint64    // size of the archives made of them
+	// AvgCompressionRatio is UncompressedBytes divided by ArchiveBytes, 0 before
+	// the first compression.
+	AvgCompressionRatio float64
+	FallbackActive      bool // the log file has moved to FallbackDir
+}
+
+// Stats returns a snapshot of the Logger's counters.
+func (l *Logger) Stats() Stats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.millMu.Lock()
+	defer l.millMu.Unlock()
+	var ratio float64
+	if l.compressedOut > 0 {
+		ratio = float64(l.compressedIn) / float64(l.compressedOut)
+	}
+	return Stats{
+		CurrentSize:         l.size,
+		TotalRotations:      l.rotations,
+		TotalBytesWritten:   l.bytesWritten,
+		BackupCount:         l.backupCount,
+		LastRotation:        l.lastRotation,
+		DroppedErrors:       l.droppedErrors,
+		DiskFullDrops:       l.diskFullDrops,
+		DiskLow:             l.diskLow,
+		WriteTimeouts:       l.writeTimeouts,
+		DroppedWrites:       l.droppedWrites,
+		FailedBytes:         l.failedBytes,
+		MemoryBuffered:      l.mem.size,
+		MemoryDrops:         l.mem.drops,
+		CompressionQueue:    l.compressNew + l.compressQueue,
+		CompressionsRunning: l.compressActive,
+		UncompressedBytes:   l.compressedIn,
+		ArchiveBytes:        l.compressedOut,
+		AvgCompressionRatio: ratio,
+		FallbackActive:      l.fallback != "",
+	}
+}
+
+// ResetStats zeroes the cumulative counters of Stats. The current size,
+// backup count and last rotation time describe the present state and are
+// kept.
+func (l *Logger) ResetStats() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.millMu.Lock()
+	defer l.millMu.Unlock()
+	l.rotations = 0
+	l.bytesWritten = 0
+	l.diskFullDrops = 0
+	l.writeTimeouts = 0
+	l.droppedWrites = 0
+	l.failedBytes = 0
+	l.mem.drops = 0
+	l.droppedErrors = 0
+	l.compressedIn = 0
+	l.compressedOut = 0
+}
@@ -0,0 +1,73 @@
+package rollinglogger
+
+import "time"
+
+// startTicker starts the goroutine that syncs and rotates by time while no
+// writes come in, if FlushInterval or a rotation period is set. It runs
+// until Close or Shutdown.
+func (l *Logger) startTicker() {
+	if l.tickStop != nil || (l.FlushInterval <= 0 && l.period() <= 0) {
+		return
+	}
+	l.tickStop = make(chan struct{})
+	l.tickDone = make(chan struct{})
+	go l.tick(l.tickStop, l.tickDone)
+}
+
+// detachTicker takes the ticker off the Logger and returns a function that
+// stops it and waits for it to exit. The caller holds l.mu, which the
+// ticker needs, so the returned function must be called after unlocking.
+func (l *Logger) detachTicker() func() {
+	stop, done := l.tickStop, l.tickDone
+	l.tickStop, l.tickDone = nil, nil
+	return func() {
+		if stop != nil {
+			close(stop)
+			<-done
+		}
+	}
+}
+
+func (l *Logger) tick(stop, done chan struct{}) {
+	defer close(done)
+	for {
+		timer := time.NewTimer(l.tickWait())
+		select {
+		case <-stop:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		l.mu.Lock()
+		// leave a file with a timed out write pending alone rather than
+		// blocking writers behind it
+		if l.fd != nil && l.settle(false) {
+			var err error
+			if l.periodChanged() {
+				err = l.makeNewFile()
+			}
+			if err == nil && l.FlushInterval > 0 && l.fd != nil {
+				err = l.sync()
+			}
+			if err != nil {
+				l.report(err)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// tickWait returns the time until the next flush or period boundary,
+// whichever comes first.
+func (l *Logger) tickWait() time.Duration {
+	wait := l.FlushInterval
+	if period := l.period(); period > 0 {
+		now := l.now()
+		next := nextPeriod(now, period).Sub(now)
+		if wait <= 0 || next < wait {
+			wait = next
+		}
+	}
+	return wait
+}
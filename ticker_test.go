@@ -0,0 +1,110 @@
+package rollinglogger
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// waitContent waits for the file at path to hold want.
+func waitContent(t *testing.T, path, want string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		b, _ := ioutil.ReadFile(path)
+		if string(b) == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s holds %q, want %q", path, b, want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestFlushIntervalAfterReopenAndRotate(t *testing.T) {
+	opens := map[string]func(l *Logger) error{
+		"reopen": func(l *Logger) error {
+			if err := l.Close(); err != nil {
+				return err
+			}
+			return l.Reopen()
+		},
+		"rotate": func(l *Logger) error { return l.Rotate() },
+		"reset":  func(l *Logger) error { return l.Reset() },
+	}
+	for name, open := range opens {
+		dir, cleanup := tempDir(t)
+		path := filepath.Join(dir, "a.log")
+		l, err := New(path, func(l *Logger) {
+			l.BufferSize = 4096
+			l.FlushInterval = 10 * time.Millisecond
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := open(l); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		writeString(t, l, "buffered\n")
+		waitContent(t, path, "buffered\n")
+		l.Close()
+		cleanup()
+	}
+}
+
+func TestPeriodAcrossDST(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip(err)
+	}
+	at := func(month time.Month, day, hour, min int) time.Time {
+		return time.Date(2021, month, day, hour, min, 0, 0, berlin)
+	}
+	day, hour := 24*time.Hour, time.Hour
+	tests := []struct {
+		t      time.Time
+		period time.Duration
+		start  time.Time
+		next   time.Time
+	}{
+		// clocks go forward at 02:00 on March 28 and back at 03:00 on
+		// October 31
+		{at(3, 28, 0, 30), day, at(3, 28, 0, 0), at(3, 29, 0, 0)},
+		{at(3, 28, 4, 0), day, at(3, 28, 0, 0), at(3, 29, 0, 0)},
+		{at(3, 28, 23, 30), day, at(3, 28, 0, 0), at(3, 29, 0, 0)},
+		{at(10, 31, 23, 30), day, at(10, 31, 0, 0), at(11, 1, 0, 0)},
+		{at(3, 28, 1, 30), hour, at(3, 28, 1, 0), at(3, 28, 3, 0)},
+		{at(3, 28, 3, 30), hour, at(3, 28, 3, 0), at(3, 28, 4, 0)},
+		{at(3, 28, 13, 0), 12 * hour, at(3, 28, 12, 0), at(3, 29, 0, 0)},
+		{at(10, 31, 11, 0), 12 * hour, at(10, 31, 0, 0), at(10, 31, 12, 0)},
+	}
+	for _, tt := range tests {
+		if got := periodStart(tt.t, tt.period); !got.Equal(tt.start) {
+			t.Errorf("periodStart(%v, %v) = %v, want %v", tt.t, tt.period, got, tt.start)
+		}
+		if got := nextPeriod(tt.t, tt.period); !got.Equal(tt.next) {
+			t.Errorf("nextPeriod(%v, %v) = %v, want %v", tt.t, tt.period, got, tt.next)
+		}
+	}
+
+	// the repeated hour after clocks go back still has a later boundary
+	second := at(10, 31, 2, 30).Add(hour)
+	if next := nextPeriod(second, 30*time.Minute); !next.After(second) {
+		t.Errorf("nextPeriod(%v) = %v, not after it", second, next)
+	}
+
+	now := at(3, 28, 4, 0)
+	l := &Logger{Daily: true, openTime: at(3, 28, 0, 30), clock: func() time.Time { return now }}
+	if l.periodChanged() {
+		t.Error("Daily rotates within a day that changes to daylight saving time")
+	}
+	if wait := l.tickWait(); wait != 20*hour {
+		t.Errorf("tickWait at %v is %v, want 20h", now, wait)
+	}
+	now = at(3, 29, 0, 0)
+	if !l.periodChanged() {
+		t.Error("Daily does not rotate at midnight")
+	}
+}
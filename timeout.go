@@ -0,0 +1,68 @@
+package rollinglogger
+
+import (
+	"fmt"
+	"time"
+)
+
+// stall is a write that outlived WriteTimeout and is still running.
+type stall struct {
+	done chan struct{}
+	n    int // bytes it wrote, valid once done is closed
+}
+
+// writeOut runs w from off, giving up after WriteTimeout. A write that
+// times out cannot be cancelled; it keeps running in its goroutine and the
+// file is left alone until it returns, so writes never overlap.
+func (l *Logger) writeOut(w func(off int) (int, error), off int) (int, error) {
+	if l.WriteTimeout <= 0 {
+		return w(off)
+	}
+	type result struct {
+		n   int
+		err error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		n, err := w(off)
+		ch <- result{n, err}
+	}()
+	timer := time.NewTimer(l.WriteTimeout)
+	defer timer.Stop()
+	select {
+	case r := <-ch:
+		return r.n, r.err
+	case <-timer.C:
+	}
+	st := &stall{done: make(chan struct{})}
+	go func() {
+		st.n = (<-ch).n
+		close(st.done)
+	}()
+	l.stalled = st
+	l.writeTimeouts++
+	return 0, fmt.Errorf("%w: %s after %v", ErrWriteTimeout, l.filename(), l.WriteTimeout)
+}
+
+// settle reports whether no timed out write is still running, first
+// waiting for it if wait is set. The bytes it wrote are counted once it has
+// finished.
+func (l *Logger) settle(wait bool) bool {
+	st := l.stalled
+	if st == nil {
+		return true
+	}
+	if wait {
+		<-st.done
+	} else {
+		select {
+		case <-st.done:
+		default:
+			return false
+		}
+	}
+	l.stalled = nil
+	l.size += int64(st.n)
+	l.bytesWritten += uint64(st.n)
+	return true
+}